@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"github.com/discoriver/massh"
+	"golang.org/x/crypto/ssh"
+	"time"
+)
+
+func main() {
+	j := &massh.Job{
+		Command: "echo \"Hello, World\"; echo \"Goodbye\" >&2",
+	}
+
+	sshc := &ssh.ClientConfig{
+		// Fake credentials
+		User:            "u01",
+		Auth:            []ssh.AuthMethod{ssh.Password("password")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         time.Duration(2) * time.Second,
+	}
+
+	cfg := massh.NewConfig()
+	cfg.SSHConfig = sshc
+	cfg.Job = j
+	cfg.WorkerPool = 10
+	cfg.SetHosts([]string{"192.168.1.118", "192.168.1.119"})
+
+	events, err := cfg.Events()
+	if err != nil {
+		panic(err)
+	}
+
+	// Everything arrives on the one channel, which is closed once the run has finished.
+	for e := range events {
+		switch e.Type {
+		case massh.HostConnecting, massh.HostStarted:
+			fmt.Printf("%s: %s\n", e.Host, e.Type)
+		case massh.StdoutLine:
+			fmt.Printf("%s: %s", e.Host, e.Data)
+		case massh.StderrLine:
+			fmt.Printf("%s (stderr): %s", e.Host, e.Data)
+		case massh.HostExited:
+			fmt.Printf("%s: exited with status %d\n", e.Host, e.Result.ExitCode)
+		case massh.HostFailed:
+			fmt.Printf("%s: %s\n", e.Host, e.Err)
+		case massh.RunFinished:
+			fmt.Println("Everything returned.")
+		}
+	}
+}
@@ -36,16 +36,15 @@ func main() {
 	cfg.SetHosts([]string{"192.168.1.118"})
 
 
-	resChan := make(chan massh.Result)
+	resChan := make(chan *massh.Result)
 
 	// This should be the last responsibility from the massh package. Handling the Result channel is up to the user.
-	err := cfg.Stream(resChan)
+	handle, err := cfg.Stream(resChan)
 	if err != nil {
 		panic(err)
 	}
 
 	var wg sync.WaitGroup
-	numberOfExpectedCompletions := len(cfg.Hosts) * len(*cfg.JobStack)
 	// This can probably be cleaner. We're hindered somewhat, I think, by reading a channel from a channel.
 	for {
 		select {
@@ -59,22 +58,19 @@ func main() {
 					readStream(result, &wg)
 				}
 			}()
-		default:
-			if massh.NumberOfStreamingHostsCompleted == numberOfExpectedCompletions {
-				// We want to wait for all goroutines to complete before we declare that the work is finished, as
-				// it's possible for us to execute this code before the gofunc above has completed if left unchecked.
-				wg.Wait()
+		case <-handle.Done():
+			// The goroutines above may still be reading output, until each DoneChannel is written to.
+			wg.Wait()
 
-				// This should always be the last thing written. Waiting above ensures this.
-				fmt.Println("Everything returned.")
-				return
-			}
+			// This should always be the last thing written. Waiting above ensures this.
+			fmt.Println("Everything returned.")
+			return
 		}
 	}
 }
 
 // Read Stdout stream
-func readStream(res massh.Result, wg *sync.WaitGroup) error {
+func readStream(res *massh.Result, wg *sync.WaitGroup) error {
 	for {
 		select {
 		case d := <-res.StdOutStream:
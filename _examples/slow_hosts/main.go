@@ -29,12 +29,12 @@ func main() {
 	cfg.SetHosts([]string{"192.168.1.118"})
 
 	// Should be slow, bump to 6 if not.
-	cfg.SlowTimeout = 5
+	cfg.SlowTimeout = 5 * time.Second
 
 	resChan := make(chan *massh.Result)
 
 	// This should be the last responsibility from the massh package. Handling the Result channel is up to the user.
-	err := cfg.Stream(resChan)
+	handle, err := cfg.Stream(resChan)
 	if err != nil {
 		panic(err)
 	}
@@ -59,15 +59,12 @@ func main() {
 					readStream(result, &wg)
 				}
 			}()
-		default:
-			if massh.NumberOfStreamingHostsCompleted == len(cfg.Hosts) {
-				// We want to wait for all goroutines to complete before we declare that the work is finished, as
-				// it's possible for us to execute this code before the gofunc above has completed if left unchecked.
-				wg.Wait()
+		case <-handle.Done():
+			// The goroutines above may still be reading output, until each DoneChannel is written to.
+			wg.Wait()
 
-				// This should always be the last thing written. Waiting above ensures this.
-				return
-			}
+			// This should always be the last thing written. Waiting above ensures this.
+			return
 		}
 	}
 }
@@ -30,7 +30,7 @@ func main() {
 	resChan := make(chan *massh.Result)
 
 	// This should be the last responsibility from the massh package. Handling the Result channel is up to the user.
-	err := cfg.Stream(resChan)
+	handle, err := cfg.Stream(resChan)
 	if err != nil {
 		panic(err)
 	}
@@ -55,16 +55,13 @@ func main() {
 					readStream(result, &wg)
 				}
 			}()
-		default:
-			if massh.NumberOfStreamingHostsCompleted == len(cfg.Hosts) {
-				// We want to wait for all goroutines to complete before we declare that the work is finished, as
-				// it's possible for us to execute this code before the gofunc above has completed if left unchecked.
-				wg.Wait()
+		case <-handle.Done():
+			// The goroutines above may still be reading output, until each DoneChannel is written to.
+			wg.Wait()
 
-				// This should always be the last thing written. Waiting above ensures this.
-				fmt.Println("Everything returned.")
-				return
-			}
+			// This should always be the last thing written. Waiting above ensures this.
+			fmt.Println("Everything returned.")
+			return
 		}
 	}
 }
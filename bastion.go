@@ -0,0 +1,229 @@
+package massh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"strings"
+	"sync"
+)
+
+var errBastionPoolClosed = errors.New("bastion connections have been closed")
+
+// bastionPool shares bastion connections between every host in a single run, rather than connecting to the bastion
+// once per host. Each distinct chain of jump hosts has up to size connections, which are used in turn.
+type bastionPool struct {
+	size int
+
+	mu     sync.Mutex
+	chains map[string][]*bastionSlot
+	next   map[string]int
+	closed bool
+}
+
+// bastionSlot holds a single connection through a chain of jump hosts. clients is ordered the same as the chain, so
+// the last client is used to reach hosts.
+type bastionSlot struct {
+	mu      sync.Mutex
+	clients []*ssh.Client
+	// The connection in progress, if there is one. It's never held under mu, so hosts waiting for it can give up.
+	dialing *bastionDial
+}
+
+// bastionDial is a connection through a chain of jump hosts that's in progress. Hosts that need the chain while it's
+// connecting wait for it, rather than connecting again, and share it's result. Nothing is shared once it's finished,
+// so a host retrying after a failure always connects again.
+type bastionDial struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	// Number of hosts waiting for the connection, guarded by the slot's mutex. It's cancelled if they all give up.
+	waiters int
+	client  *ssh.Client
+	err     error
+}
+
+// newBastionPool creates a pool whose connections live until close is called.
+func newBastionPool(size int) *bastionPool {
+	if size < 1 {
+		size = 1
+	}
+	return &bastionPool{
+		size:   size,
+		chains: map[string][]*bastionSlot{},
+		next:   map[string]int{},
+	}
+}
+
+// bastionChainKey identifies a chain of jump hosts. Chains with the same hosts, but different users, are kept separate.
+func bastionChainKey(jumps []*hostTarget) string {
+	hops := make([]string, len(jumps))
+	for i, j := range jumps {
+		hops[i] = j.sshConfig.User + "@" + j.addr
+	}
+	return strings.Join(hops, ",")
+}
+
+// get returns a client connected through the chain of jump hosts, connecting if there isn't one already. Waiting for,
+// and making, the connection is abandoned if ctx is done.
+func (p *bastionPool) get(ctx context.Context, network string, jumps []*hostTarget) (*bastionSlot, *ssh.Client, error) {
+	key := bastionChainKey(jumps)
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, nil, errBastionPoolClosed
+	}
+	slots, ok := p.chains[key]
+	if !ok {
+		slots = make([]*bastionSlot, p.size)
+		for i := range slots {
+			slots[i] = &bastionSlot{}
+		}
+		p.chains[key] = slots
+	}
+	slot := slots[p.next[key]%p.size]
+	p.next[key]++
+	p.mu.Unlock()
+
+	client, err := slot.get(ctx, p, network, jumps)
+	return slot, client, err
+}
+
+// close closes every bastion connection. Any further calls to get will fail.
+func (p *bastionPool) close() {
+	p.mu.Lock()
+	p.closed = true
+	chains := p.chains
+	p.mu.Unlock()
+
+	for _, slots := range chains {
+		for _, slot := range slots {
+			slot.mu.Lock()
+			if slot.dialing != nil {
+				slot.dialing.cancel()
+			}
+			closeBastionChain(slot.clients)
+			slot.clients = nil
+			slot.mu.Unlock()
+		}
+	}
+}
+
+func (s *bastionSlot) get(ctx context.Context, p *bastionPool, network string, jumps []*hostTarget) (*ssh.Client, error) {
+	s.mu.Lock()
+	if s.clients != nil {
+		client := s.clients[len(s.clients)-1]
+		s.mu.Unlock()
+		return client, nil
+	}
+	d := s.dialing
+	if d == nil {
+		// The connection outlives the host that started it, so it's only cancelled if every waiting host gives up.
+		dialCtx, cancel := context.WithCancel(context.Background())
+		d = &bastionDial{done: make(chan struct{}), cancel: cancel}
+		s.dialing = d
+		go s.dial(dialCtx, d, p, network, jumps)
+	}
+	d.waiters++
+	s.mu.Unlock()
+
+	select {
+	case <-d.done:
+		return d.client, d.err
+	case <-ctx.Done():
+		s.mu.Lock()
+		d.waiters--
+		if d.waiters == 0 && s.dialing == d {
+			d.cancel()
+			// Hosts that come along later start again, rather than waiting for a cancelled connection.
+			s.dialing = nil
+		}
+		s.mu.Unlock()
+		return nil, contextError(jumps[0].addr, ctx.Err())
+	}
+}
+
+// dial connects through the chain of jump hosts for d, and keeps the connection for the rest of the pool to use.
+func (s *bastionSlot) dial(ctx context.Context, d *bastionDial, p *bastionPool, network string, jumps []*hostTarget) {
+	defer d.cancel()
+	clients, err := dialBastionChain(ctx, network, jumps)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer close(d.done)
+
+	if s.dialing == d {
+		s.dialing = nil
+	}
+	if err != nil {
+		d.err = err
+		return
+	}
+
+	// The pool may have been closed while we were connecting, or a newer connection may have been made after this one
+	// was given up on.
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		closeBastionChain(clients)
+		d.err = errBastionPoolClosed
+		return
+	}
+	if s.clients != nil {
+		closeBastionChain(clients)
+		d.client = s.clients[len(s.clients)-1]
+		return
+	}
+	s.clients = clients
+
+	// Forget the chain if any of it's connections drop, so that the next host will reconnect.
+	last := clients[len(clients)-1]
+	go func() {
+		last.Wait()
+		s.discard(last)
+	}()
+	d.client = last
+}
+
+// discard closes and forgets the slot's connection, if client is still the one in use. Subsequent calls to get will
+// reconnect.
+func (s *bastionSlot) discard(client *ssh.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.clients != nil && s.clients[len(s.clients)-1] == client {
+		closeBastionChain(s.clients)
+		s.clients = nil
+	}
+}
+
+// dialBastionChain connects to each of the jump hosts in turn, each through the previous one.
+func dialBastionChain(ctx context.Context, network string, jumps []*hostTarget) ([]*ssh.Client, error) {
+	var clients []*ssh.Client
+
+	bastionClient, err := dial(ctx, network, jumps[0].addr, jumps[0].sshConfig)
+	if err != nil {
+		return nil, newError(ErrBastion, jumps[0].addr, fmt.Errorf("unable to connect to bastion %s: %w", jumps[0].addr, err))
+	}
+	clients = append(clients, bastionClient)
+
+	for _, j := range jumps[1:] {
+		bastionClient, err = dialViaClient(ctx, network, bastionClient, j.addr, j.sshConfig)
+		if err != nil {
+			closeBastionChain(clients)
+			return nil, newError(ErrBastion, j.addr, fmt.Errorf("unable to connect to bastion %s: %w", j.addr, err))
+		}
+		clients = append(clients, bastionClient)
+	}
+
+	return clients, nil
+}
+
+// closeBastionChain closes the clients, starting with the furthest hop.
+func closeBastionChain(clients []*ssh.Client) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		clients[i].Close()
+	}
+}
@@ -0,0 +1,113 @@
+package massh
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testListener accepts connections, counting them, and either holds them open without ever responding, or closes
+// them straight away.
+func testListener(t *testing.T, hold bool) (addr string, accepted *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	accepted = new(int32)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			if hold {
+				t.Cleanup(func() { conn.Close() })
+			} else {
+				conn.Close()
+			}
+		}
+	}()
+	return l.Addr().String(), accepted
+}
+
+func TestBastionPoolCancel(t *testing.T) {
+	addr, _ := testListener(t, true)
+	jumps := []*hostTarget{{addr: addr, sshConfig: &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()}}}
+	pool := newBastionPool(1)
+	defer pool.close()
+
+	// The first host hangs in the handshake, and the second waits for it, but both can be cancelled.
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		go func() {
+			_, _, err := pool.get(ctx, "tcp", jumps)
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, ErrTimeout) {
+				t.Errorf("Expected a timeout, got: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Cancelled bastion connection didn't return")
+		}
+	}
+}
+
+func TestBastionPoolSharedDial(t *testing.T) {
+	// The bastion takes a while to fail, so every host asks for it while the first connection is still in progress.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := new(int32)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			time.AfterFunc(200*time.Millisecond, func() { conn.Close() })
+		}
+	}()
+
+	jumps := []*hostTarget{{addr: l.Addr().String(), sshConfig: &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()}}}
+	pool := newBastionPool(1)
+	defer pool.close()
+
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, _, err := pool.get(context.Background(), "tcp", jumps)
+			errs <- err
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-errs; !errors.Is(err, ErrBastion) {
+			t.Errorf("Expected a bastion error, got: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Errorf("Expected a single connection to the bastion, got %d", n)
+	}
+
+	// The failure isn't remembered, so the next host connects again.
+	pool.get(context.Background(), "tcp", jumps)
+	if n := atomic.LoadInt32(accepted); n != 2 {
+		t.Errorf("Expected the bastion to be connected to again, got %d connections", n)
+	}
+}
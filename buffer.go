@@ -0,0 +1,316 @@
+package massh
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy controls what happens to streamed output when a Result's StdOutStream or StdErrStream is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for the output to be read, which holds up the host's job until it is. This is the default.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest buffered output to make room, so the job is never held up. Discarded
+	// output is counted in Result.Dropped.
+	OverflowDropOldest
+	// OverflowSpill writes output to a temporary file until the stream has room for it again, so the job is never
+	// held up, and no output is lost.
+	OverflowSpill
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropOldest:
+		return "drop oldest"
+	case OverflowSpill:
+		return "spill"
+	}
+	return "unknown"
+}
+
+// outputStream sends output to one of a Result's stream channels, applying Config.Overflow once Config.StreamBufferSize
+// frames are waiting to be read. The channel itself is unbuffered, and frames are held in a queue until forward hands
+// them over, so the stream always knows whether everything sent to it has been read. Output is abandoned once done is
+// closed, so a host that has been cancelled isn't held up by a consumer that has gone away.
+type outputStream struct {
+	ch      chan []byte
+	done    <-chan struct{}
+	policy  OverflowPolicy
+	size    int
+	dropped *int64
+
+	mu      sync.Mutex
+	queue   [][]byte // Frames waiting to be read, oldest first. The first is the one being offered to ch.
+	head    uint64   // Number of frames removed from the front of queue, whether they were read or dropped.
+	spool   *spool   // Frames that didn't fit in queue, when using OverflowSpill.
+	closed  bool     // Set once all output has been sent to the stream.
+	stopped bool     // Set once forward has returned, after which output is discarded.
+	err     error
+
+	wake   chan struct{} // Tells forward that queue has changed.
+	room   chan struct{} // Tells a blocked send that a frame has been read.
+	exited chan struct{}
+}
+
+// newOutputStream creates the channel for a stream, and starts handing output over to it. The stream must be closed
+// once all output has been sent to it.
+func newOutputStream(c *Config, done <-chan struct{}, dropped *int64) *outputStream {
+	size := c.StreamBufferSize
+	if c.Overflow != OverflowBlock && size < 1 {
+		// There's nowhere to put output until it's read otherwise.
+		size = 1
+	}
+
+	s := &outputStream{
+		ch:      make(chan []byte),
+		done:    done,
+		policy:  c.Overflow,
+		size:    size,
+		dropped: dropped,
+		wake:    make(chan struct{}, 1),
+		room:    make(chan struct{}, 1),
+		exited:  make(chan struct{}),
+	}
+	if s.policy == OverflowSpill {
+		s.spool = &spool{}
+	}
+	go s.forward()
+	return s
+}
+
+// send passes a frame of output to the stream.
+func (s *outputStream) send(frame []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return
+	}
+
+	switch s.policy {
+	case OverflowDropOldest:
+		if len(s.queue) == s.size {
+			s.pop()
+			atomic.AddInt64(s.dropped, 1)
+		}
+		s.queue = append(s.queue, frame)
+	case OverflowSpill:
+		// Frames are only added to the queue once nothing is waiting in the file, so they're always sent in order.
+		if s.spool.pending > 0 || len(s.queue) == s.size {
+			if s.err == nil {
+				if err := s.spool.write(frame); err != nil {
+					s.err = fmt.Errorf("couldn't spill output to a temporary file: %w", err)
+				}
+			}
+			return
+		}
+		s.queue = append(s.queue, frame)
+	default:
+		s.queue = append(s.queue, frame)
+		notify(s.wake)
+
+		// Like sending to a full channel, wait until the frame fits.
+		for len(s.queue) > s.size && !s.stopped {
+			s.mu.Unlock()
+			select {
+			case <-s.room:
+				s.mu.Lock()
+			case <-s.done:
+				s.mu.Lock()
+				return
+			}
+		}
+		return
+	}
+	notify(s.wake)
+}
+
+// pop removes the oldest frame from queue. s.mu must be held.
+func (s *outputStream) pop() {
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+	s.head++
+}
+
+// refill moves spilled frames back into queue while there's room for them. s.mu must be held.
+func (s *outputStream) refill() {
+	for s.spool != nil && s.spool.pending > 0 && len(s.queue) < s.size {
+		frame, err := s.spool.next()
+		if err != nil {
+			// The rest of the file can't be trusted, so it's discarded.
+			s.err = fmt.Errorf("couldn't read spilled output: %w", err)
+			s.spool.reset()
+			return
+		}
+		s.queue = append(s.queue, frame)
+
+		if s.spool.pending == 0 {
+			// Start the file again, rather than letting it grow.
+			if err := s.spool.reset(); err != nil {
+				s.err = fmt.Errorf("couldn't truncate spilled output: %w", err)
+			}
+		}
+	}
+}
+
+// forward offers the oldest frame to ch until the stream is closed and every frame has been read, or done is closed.
+func (s *outputStream) forward() {
+	defer close(s.exited)
+	defer s.stop()
+
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return
+			}
+
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		frame, head := s.queue[0], s.head
+		s.mu.Unlock()
+
+		select {
+		case s.ch <- frame:
+			s.mu.Lock()
+			if s.head == head {
+				s.pop()
+				s.refill()
+			} else {
+				// The frame was dropped while it was being read, so it wasn't really dropped.
+				atomic.AddInt64(s.dropped, -1)
+			}
+			s.mu.Unlock()
+			notify(s.room)
+		case <-s.wake:
+			// The frame may have been dropped, so the oldest frame is checked again.
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// stop discards anything that hasn't been read, once forward has returned.
+func (s *outputStream) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+	s.queue = nil
+	if s.spool != nil {
+		s.spool.remove()
+	}
+}
+
+// close records that all output has been sent to the stream. It's safe to call close on a nil stream.
+func (s *outputStream) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	notify(s.wake)
+}
+
+// drain waits for everything sent to the stream to be read, or for done to be closed, so that DoneChannel isn't
+// written to before the output is received. It returns an error if output couldn't be spilled. It's safe to call
+// drain on a nil stream.
+func (s *outputStream) drain() error {
+	if s == nil {
+		return nil
+	}
+	<-s.exited
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// notify signals ch without blocking. ch must be buffered, so a signal sent while nobody is waiting isn't lost.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// spool holds output in a temporary file while a stream's queue is full, so it can be sent on in order once there's
+// room. The file is only created if it's needed. It's guarded by the stream's mutex.
+type spool struct {
+	file    *os.File
+	readAt  int64
+	writeAt int64
+	pending int // Frames in the file that haven't been read yet.
+}
+
+// write appends a length prefixed frame to the file, creating it if needed.
+func (s *spool) write(frame []byte) error {
+	if s.file == nil {
+		f, err := ioutil.TempFile("", "massh-spill-")
+		if err != nil {
+			return err
+		}
+		s.file = f
+	}
+
+	buf := make([]byte, 4+len(frame))
+	binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+	copy(buf[4:], frame)
+	if _, err := s.file.WriteAt(buf, s.writeAt); err != nil {
+		return err
+	}
+	s.writeAt += int64(len(buf))
+	s.pending++
+	return nil
+}
+
+// next reads the oldest frame from the file.
+func (s *spool) next() ([]byte, error) {
+	var size [4]byte
+	if _, err := s.file.ReadAt(size[:], s.readAt); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := s.file.ReadAt(frame, s.readAt+4); err != nil && err != io.EOF {
+		return nil, err
+	}
+	s.readAt += 4 + int64(len(frame))
+	s.pending--
+	return frame, nil
+}
+
+// reset discards everything in the file.
+func (s *spool) reset() error {
+	s.pending = 0
+	s.readAt, s.writeAt = 0, 0
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Truncate(0)
+}
+
+// remove deletes the file, if one was created.
+func (s *spool) remove() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+		s.file = nil
+	}
+	s.pending = 0
+}
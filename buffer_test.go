@@ -0,0 +1,118 @@
+package massh
+
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOutputStreamDropOldest(t *testing.T) {
+	var dropped int64
+	s := newOutputStream(&Config{StreamBufferSize: 2, Overflow: OverflowDropOldest}, nil, &dropped)
+
+	// Nothing is reading, but sending shouldn't block.
+	for i := 0; i < 5; i++ {
+		s.send([]byte(strconv.Itoa(i)))
+	}
+	s.close()
+	// The stream may still be offering a frame that's since been dropped, so give it a moment to catch up.
+	time.Sleep(10 * time.Millisecond)
+
+	if atomic.LoadInt64(&dropped) != 3 {
+		t.Errorf("Expected 3 frames to be dropped, got %d", dropped)
+	}
+	for _, want := range []string{"3", "4"} {
+		if got := string(<-s.ch); got != want {
+			t.Errorf("Expected the newest frames to be kept, got %q, expected %q", got, want)
+		}
+	}
+	if err := s.drain(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestOutputStreamSpill(t *testing.T) {
+	done := make(chan struct{})
+	s := newOutputStream(&Config{Overflow: OverflowSpill}, done, nil)
+
+	// Nothing is reading, so everything but the first frame is spilled.
+	for i := 0; i < 1000; i++ {
+		s.send([]byte(strconv.Itoa(i)))
+	}
+	s.mu.Lock()
+	if s.spool.file == nil || s.spool.pending != 999 {
+		t.Fatalf("Expected 999 frames to be spilled to a file, got %d", s.spool.pending)
+	}
+	name := s.spool.file.Name()
+	s.mu.Unlock()
+	s.close()
+
+	for i := 0; i < 1000; i++ {
+		if got := string(<-s.ch); got != strconv.Itoa(i) {
+			t.Fatalf("Expected frame %d, got %q", i, got)
+		}
+	}
+	if err := s.drain(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("Expected spill file to be removed, got: %v", err)
+	}
+}
+
+func TestOutputStreamDone(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowBlock, OverflowSpill} {
+		done := make(chan struct{})
+		s := newOutputStream(&Config{StreamBufferSize: 1, Overflow: policy}, done, nil)
+		s.send([]byte("first"))
+
+		// Once done is closed, an abandoned stream shouldn't hold anything up.
+		close(done)
+		finished := make(chan struct{})
+		go func() {
+			s.send([]byte("second"))
+			s.close()
+			s.drain()
+			close(finished)
+		}()
+
+		select {
+		case <-finished:
+		case <-time.After(time.Second):
+			t.Errorf("%s: stream blocked after done was closed", policy)
+		}
+	}
+}
+
+func TestOutputStreamDrain(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowBlock, OverflowDropOldest, OverflowSpill} {
+		s := newOutputStream(&Config{StreamBufferSize: 10, Overflow: policy}, nil, new(int64))
+		for i := 0; i < 5; i++ {
+			s.send([]byte(strconv.Itoa(i)))
+		}
+		s.close()
+
+		drained := make(chan struct{})
+		go func() {
+			s.drain()
+			close(drained)
+		}()
+
+		// drain must wait until the last frame has been read, not just taken from the buffer.
+		for i := 0; i < 5; i++ {
+			select {
+			case <-drained:
+				t.Fatalf("%s: drain returned with %d frames still to be read", policy, 5-i)
+			case <-time.After(10 * time.Millisecond):
+			}
+			<-s.ch
+		}
+		select {
+		case <-drained:
+		case <-time.After(time.Second):
+			t.Errorf("%s: drain didn't return once every frame was read", policy)
+		}
+	}
+}
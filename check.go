@@ -28,6 +28,12 @@ func checkConfigSanity(c *Config) error {
 	if c.WorkerPool == 0 {
 		e = append(e, "WorkerPool")
 	}
+	if c.Rolling != nil && !c.Rolling.valid() {
+		e = append(e, "Rolling")
+	}
+	if c.Canary.check(c.Hosts) != nil {
+		e = append(e, "Canary")
+	}
 
 	if e != nil {
 		return fmt.Errorf("bad config, the following config items are not correct: %s", e[0:])
@@ -43,3 +49,12 @@ func checkJobs(c *Config) error {
 	}
 	return nil
 }
+
+// checkRun checks the config before a run is started, so that it isn't started with config that would make it
+// misbehave.
+func checkRun(c *Config) error {
+	if err := checkJobs(c); err != nil {
+		return err
+	}
+	return c.Canary.check(c.Hosts)
+}
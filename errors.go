@@ -0,0 +1,84 @@
+package massh
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Kinds of Error, which can be checked for with errors.Is.
+var (
+	// ErrDial indicates that the host couldn't be connected to, including failed SSH handshakes.
+	ErrDial = errors.New("dial failed")
+	// ErrAuth indicates that the host rejected every authentication method.
+	ErrAuth = errors.New("authentication failed")
+	// ErrHostKey indicates that the host's key was rejected by the HostKeyCallback. The cause is usually a
+	// *HostKeyError.
+	ErrHostKey = errors.New("host key rejected")
+	// ErrBastion indicates that a bastion, or jump host, couldn't be connected to.
+	ErrBastion = errors.New("bastion failed")
+	// ErrSession indicates that a session couldn't be created or used, or the connection dropped while the job was
+	// running.
+	ErrSession = errors.New("session failed")
+	// ErrStart indicates that the job couldn't be started.
+	ErrStart = errors.New("job failed to start")
+	// ErrRead indicates that the job's output couldn't be read.
+	ErrRead = errors.New("read failed")
+	// ErrRemoteExit indicates that the remote command exited with a non-zero status, or without reporting one. The
+	// cause is an *ssh.ExitError or *ssh.ExitMissingError.
+	ErrRemoteExit = errors.New("remote command failed")
+	// ErrCancelled indicates that the host was cancelled by the caller, because the run was aborted, or because the
+	// host was slow.
+	ErrCancelled = errors.New("cancelled")
+	// ErrTimeout indicates that a deadline was reached. A dial that times out is also an ErrTimeout.
+	ErrTimeout = errors.New("timed out")
+)
+
+// Error is the type of error reported in Result.Error. Kind is one of the errors above, and Err is the underlying
+// cause, both of which can be checked for with errors.Is and errors.As.
+type Error struct {
+	Kind error
+	Host string // The address that failed, which may be a bastion rather than the Result's host.
+	Err  error
+}
+
+// Error returns the message of the underlying cause.
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying cause.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the error's Kind. Errors caused by a network timeout are also an ErrTimeout.
+func (e *Error) Is(target error) bool {
+	if target == e.Kind {
+		return true
+	}
+	var netErr net.Error
+	return target == ErrTimeout && errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+func newError(kind error, host string, err error) *Error {
+	return &Error{
+		Kind: kind,
+		Host: host,
+		Err:  err,
+	}
+}
+
+// contextError returns ctx's error as an ErrCancelled or ErrTimeout.
+func contextError(host string, err error) *Error {
+	if err == context.DeadlineExceeded {
+		return newError(ErrTimeout, host, err)
+	}
+	return newError(ErrCancelled, host, err)
+}
+
+// ErrSlowHost is the cause of an ErrCancelled when a host is cancelled for being slow.
+var ErrSlowHost = errors.New("host cancelled after reaching the slow timeout")
+
+// ErrStopped is the cause of an ErrCancelled when a host is stopped by Config.StopAllSessions.
+var ErrStopped = errors.New("host stopped by StopAllSessions")
@@ -0,0 +1,42 @@
+package massh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+	cause := errors.New("connection refused")
+	err := fmt.Errorf("wrapped: %w", newError(ErrDial, "host:22", cause))
+
+	if !errors.Is(err, ErrDial) || errors.Is(err, ErrAuth) {
+		t.Errorf("Expected only ErrDial to match")
+	}
+	if !errors.Is(err, cause) {
+		t.Errorf("Expected the cause to be unwrapped")
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.Host != "host:22" || e.Error() != cause.Error() {
+		t.Errorf("Expected an *Error for host:22, got: %+v", e)
+	}
+
+	// A dial that times out is also an ErrTimeout.
+	_, dialErr := net.Dial("tcp", "localhost:-1")
+	if errors.Is(newError(ErrDial, "localhost", dialErr), ErrTimeout) {
+		t.Errorf("Expected a failed dial not to be a timeout")
+	}
+	timeout := &net.OpError{Op: "dial", Err: context.DeadlineExceeded}
+	if !errors.Is(newError(ErrDial, "localhost", timeout), ErrTimeout) {
+		t.Errorf("Expected a timed out dial to be ErrTimeout")
+	}
+
+	if !errors.Is(contextError("host", context.DeadlineExceeded), ErrTimeout) {
+		t.Errorf("Expected deadline exceeded to be ErrTimeout")
+	}
+	if !errors.Is(contextError("host", context.Canceled), ErrCancelled) {
+		t.Errorf("Expected cancellation to be ErrCancelled")
+	}
+}
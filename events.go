@@ -0,0 +1,106 @@
+package massh
+
+import (
+	"errors"
+	"time"
+)
+
+// EventType identifies what an Event reports.
+type EventType int
+
+const (
+	// HostConnecting is sent before connecting to a host. Job is empty, as the connection is shared by every job on
+	// the host.
+	HostConnecting EventType = iota
+	// HostStarted is sent once a job has started on the host.
+	HostStarted
+	// StdoutLine is sent for each line of a job's stdout, which is in Data. Output is split up according to
+	// Config.Framing, so it may be a chunk rather than a line.
+	StdoutLine
+	// StderrLine is sent for each line of a job's stderr, which is in Data, split up in the same way as StdoutLine.
+	StderrLine
+	// HostSlow is sent the first time a job produces no output for Config.SlowTimeout.
+	HostSlow
+	// HostExited is sent when a job's command has exited, successfully or otherwise. It's completed Result is in
+	// Result.
+	HostExited
+	// HostFailed is sent when a job couldn't be run, or didn't run to completion, for example because the host
+	// couldn't be reached or was cancelled. It's completed Result is in Result, and Err is the Result's Error.
+	HostFailed
+	// RunFinished is the last event, sent once every host has completed. Err is the reason the run was halted early,
+	// such as ErrCanaryFailed, if it was.
+	RunFinished
+)
+
+func (t EventType) String() string {
+	switch t {
+	case HostConnecting:
+		return "connecting"
+	case HostStarted:
+		return "started"
+	case StdoutLine:
+		return "stdout"
+	case StderrLine:
+		return "stderr"
+	case HostSlow:
+		return "slow"
+	case HostExited:
+		return "exited"
+	case HostFailed:
+		return "failed"
+	case RunFinished:
+		return "finished"
+	}
+	return "unknown"
+}
+
+// Event is a single step in the progress of a run started with Config.Events or Config.EventsContext.
+type Event struct {
+	Type     EventType
+	Host     string
+	Job      string
+	JobIndex int
+	Time     time.Time
+
+	Data   []byte  // The line or chunk of output, for StdoutLine and StderrLine.
+	Result *Result // The completed Result, for HostExited and HostFailed.
+	Err    error   // The Result's Error for HostFailed, or the reason the run was halted for RunFinished.
+}
+
+// emit sends an event to the run's event channel, if it's using one.
+func (ex *execution) emit(e Event) {
+	if ex.events == nil {
+		return
+	}
+	e.Time = time.Now()
+	ex.events <- e
+}
+
+// report sends an event about r's job, and calls the run's Handler, if it's using either.
+func (ex *execution) report(conn *hostConnection, t EventType, r *Result, data []byte) {
+	e := Event{
+		Type:     t,
+		Host:     r.Host,
+		Job:      r.Job,
+		JobIndex: r.JobIndex,
+		Data:     data,
+	}
+	switch t {
+	case HostExited:
+		e.Result = r
+	case HostFailed:
+		e.Result = r
+		e.Err = r.Error
+	}
+	ex.emit(e)
+	ex.callHandler(conn, t, r, data)
+}
+
+// reportCompleted reports HostExited if r's command ran until it exited, and HostFailed if it didn't.
+func (ex *execution) reportCompleted(conn *hostConnection, r *Result) {
+	if r.Error != nil && !errors.Is(r.Error, ErrRemoteExit) {
+		ex.report(conn, HostFailed, r, nil)
+	} else {
+		ex.report(conn, HostExited, r, nil)
+	}
+}
@@ -0,0 +1,149 @@
+package massh
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// defaultMaxChunkSize is the largest chunk sent when using FrameChunks, if Config.MaxChunkSize isn't set.
+const defaultMaxChunkSize = 32 * 1024
+
+// Framing controls how streamed output is split up before it's sent. Whichever is used, output that's left over when
+// the stream ends is always sent, even if it doesn't end in a newline.
+type Framing int
+
+const (
+	// FrameLines sends output one line at a time, including the trailing newline. This is the default.
+	FrameLines Framing = iota
+	// FrameChunks sends output as soon as it's received, in chunks of at most Config.MaxChunkSize bytes. Chunks
+	// aren't aligned to lines, which makes it suitable for prompts and binary output.
+	FrameChunks
+	// FrameCarriageReturn is FrameLines, but a carriage return also ends a line, so progress bars that redraw a
+	// single line are sent as they update. "\r\n" is a single line ending.
+	FrameCarriageReturn
+)
+
+func (f Framing) String() string {
+	switch f {
+	case FrameLines:
+		return "lines"
+	case FrameChunks:
+		return "chunks"
+	case FrameCarriageReturn:
+		return "carriage return"
+	}
+	return "unknown"
+}
+
+// readOutput reads from reader until EOF, passing each frame of output to send. Each read is reported to monitor as
+// activity.
+func readOutput(reader io.Reader, framing Framing, maxChunkSize int, send func(frame []byte), monitor *activityMonitor) error {
+	if maxChunkSize <= 0 {
+		maxChunkSize = defaultMaxChunkSize
+	}
+
+	switch framing {
+	case FrameChunks:
+		return readChunks(reader, maxChunkSize, send, monitor)
+	case FrameCarriageReturn:
+		return readCarriageReturnLines(reader, send, monitor)
+	}
+	return readLines(reader, send, monitor)
+}
+
+// readLines sends each line read from reader, including a final line without a newline.
+func readLines(reader io.Reader, send func(line []byte), monitor *activityMonitor) error {
+	rdr := bufio.NewReader(reader)
+	for {
+		line, err := rdr.ReadBytes('\n') // ReadBytes will wait until new line character is read.
+		monitor.active()
+		// ReadBytes returns whatever it has read alongside an error, which is the final unterminated line.
+		if len(line) > 0 {
+			send(line)
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// readChunks sends the result of each read from reader, in chunks of at most maxChunkSize bytes.
+func readChunks(reader io.Reader, maxChunkSize int, send func(chunk []byte), monitor *activityMonitor) error {
+	buf := make([]byte, maxChunkSize)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			monitor.active()
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+			send(chunk)
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// readCarriageReturnLines sends each line read from reader, where a line ends in "\n", "\r" or "\r\n".
+func readCarriageReturnLines(reader io.Reader, send func(line []byte), monitor *activityMonitor) error {
+	buf := make([]byte, defaultMaxChunkSize)
+	var pending []byte
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			monitor.active()
+			pending = sendCarriageReturnLines(append(pending, buf[:n]...), send, false)
+		}
+		if err != nil {
+			sendCarriageReturnLines(pending, send, true)
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// sendCarriageReturnLines sends every complete line in p, and returns what's left. If final is set, what's left is
+// sent too.
+func sendCarriageReturnLines(p []byte, send func(line []byte), final bool) []byte {
+	var start int
+	for {
+		i := bytes.IndexAny(p[start:], "\r\n")
+		if i < 0 {
+			break
+		}
+		end := start + i + 1
+		if p[end-1] == '\r' {
+			// Wait for the next read if it's unclear whether the line ends in "\r" or "\r\n".
+			if end == len(p) && !final {
+				break
+			}
+			if end < len(p) && p[end] == '\n' {
+				end++
+			}
+		}
+		send(copyBytes(p[start:end]))
+		start = end
+	}
+
+	if final && start < len(p) {
+		send(copyBytes(p[start:]))
+		return nil
+	}
+	// Lines that have been sent are copies, so the remainder can be moved to the start of p.
+	return append(p[:0], p[start:]...)
+}
+
+func copyBytes(p []byte) []byte {
+	c := make([]byte, len(p))
+	copy(c, p)
+	return c
+}
@@ -0,0 +1,87 @@
+package massh
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		framing Framing
+		max     int
+		input   string
+		want    []string
+	}{
+		{"lines", FrameLines, 0, "one\ntwo\nthree", []string{"one\n", "two\n", "three"}},
+		{"lines carriage return", FrameLines, 0, "10%\r50%\r100%\n", []string{"10%\r50%\r100%\n"}},
+		{"chunks", FrameChunks, 4, "Password: ", []string{"Pass", "word", ": "}},
+		{"carriage return", FrameCarriageReturn, 0, "10%\r50%\r100%\ndone", []string{"10%\r", "50%\r", "100%\n", "done"}},
+		{"carriage return newline", FrameCarriageReturn, 0, "one\r\ntwo\r", []string{"one\r\n", "two\r"}},
+	}
+
+	for _, tt := range tests {
+		// Reading a byte at a time makes sure frames don't depend on how the output arrives.
+		for _, oneByte := range []bool{false, true} {
+			r := strings.NewReader(tt.input)
+			var got []string
+			send := func(frame []byte) { got = append(got, string(frame)) }
+
+			var err error
+			if oneByte {
+				err = readOutput(iotest.OneByteReader(r), tt.framing, tt.max, send, nil)
+			} else {
+				err = readOutput(r, tt.framing, tt.max, send, nil)
+			}
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", tt.name, err)
+			}
+
+			// Chunks are whatever each read returns, so they're only predictable without OneByteReader.
+			if tt.framing == FrameChunks && oneByte {
+				if strings.Join(got, "") != tt.input {
+					t.Errorf("%s: expected chunks to make up %q, got %q", tt.name, tt.input, got)
+				}
+				continue
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s (one byte reads: %t): expected %q, got %q", tt.name, oneByte, tt.want, got)
+			}
+		}
+	}
+}
+
+func TestReadOutputError(t *testing.T) {
+	readErr := errors.New("connection lost")
+
+	for _, framing := range []Framing{FrameLines, FrameChunks, FrameCarriageReturn} {
+		var got []string
+		send := func(frame []byte) { got = append(got, string(frame)) }
+
+		r := &errReader{r: strings.NewReader("partial"), err: readErr}
+		if err := readOutput(r, framing, 0, send, nil); !errors.Is(err, readErr) {
+			t.Errorf("%s: expected read error, got: %v", framing, err)
+		}
+		// Output read before the error is still sent.
+		if strings.Join(got, "") != "partial" {
+			t.Errorf("%s: expected partial output to be sent, got %q", framing, got)
+		}
+	}
+}
+
+// errReader returns err once r has been read.
+type errReader struct {
+	r   *strings.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, _ := e.r.Read(p)
+	if e.r.Len() == 0 {
+		return n, e.err
+	}
+	return n, nil
+}
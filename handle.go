@@ -0,0 +1,128 @@
+package massh
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// StreamHandle tracks the progress of a single call to Config.Stream or Config.StreamContext. Every counter is
+// specific to that call, and is safe to read from any goroutine while the run is in progress.
+type StreamHandle struct {
+	wg   sync.WaitGroup
+	done chan struct{}
+
+	started   int64
+	succeeded int64
+	failed    int64
+	slow      int64
+	skipped   int64
+
+	mu  sync.Mutex
+	err error
+}
+
+func newStreamHandle() *StreamHandle {
+	return &StreamHandle{
+		done: make(chan struct{}),
+	}
+}
+
+// Wait blocks until every host has completed it's work, successful or otherwise.
+func (h *StreamHandle) Wait() {
+	<-h.done
+}
+
+// Done returns a channel that is closed once every host has completed it's work. Every Result will have been written
+// to the results channel before Done is closed, except that a cancelled host's Result may be dropped if it wasn't
+// received, as described by Stream. Hosts don't wait for their output to be read, so output may still be waiting
+// once Done is closed, and each DoneChannel is only written to once it's Result's output has been read.
+func (h *StreamHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Started returns the number of host jobs that have begun connecting.
+func (h *StreamHandle) Started() int {
+	return int(atomic.LoadInt64(&h.started))
+}
+
+// Succeeded returns the number of host jobs that have completed, and whose Result reports Success().
+func (h *StreamHandle) Succeeded() int {
+	return int(atomic.LoadInt64(&h.succeeded))
+}
+
+// Failed returns the number of host jobs that have completed, and whose Result does not report Success().
+func (h *StreamHandle) Failed() int {
+	return int(atomic.LoadInt64(&h.failed))
+}
+
+// Completed returns the number of host jobs that have completed, successful or otherwise.
+func (h *StreamHandle) Completed() int {
+	return h.Succeeded() + h.Failed()
+}
+
+// Slow returns the number of completed host jobs that were flagged as slow.
+func (h *StreamHandle) Slow() int {
+	return int(atomic.LoadInt64(&h.slow))
+}
+
+// Skipped returns the number of host jobs that were never started, either because an earlier job failed and
+// Config.JobStackPolicy is not ContinueOnFailure, or because the run was halted.
+func (h *StreamHandle) Skipped() int {
+	return int(atomic.LoadInt64(&h.skipped))
+}
+
+// Err returns the reason the run was halted before every host was run, such as ErrCanaryFailed, or nil
+// if it wasn't. It's only final once Done has been closed.
+func (h *StreamHandle) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// setErr records the reason the run was halted.
+func (h *StreamHandle) setErr(err error) {
+	h.mu.Lock()
+	h.err = err
+	h.mu.Unlock()
+}
+
+// add registers n host jobs that will be run, and must be completed before Done is closed.
+func (h *StreamHandle) add(n int) {
+	h.wg.Add(n)
+}
+
+// skip records that n registered host jobs will not be run.
+func (h *StreamHandle) skip(n int) {
+	atomic.AddInt64(&h.skipped, int64(n))
+	h.wg.Add(-n)
+}
+
+// start records that a host job has begun.
+func (h *StreamHandle) start() {
+	atomic.AddInt64(&h.started, 1)
+}
+
+// finish records the outcome of a host job. It must be called before the host's completion is reported to the
+// caller, so that the counters are up to date once a DoneChannel has been read.
+func (h *StreamHandle) finish(r *Result) {
+	if r.Success() {
+		atomic.AddInt64(&h.succeeded, 1)
+	} else {
+		atomic.AddInt64(&h.failed, 1)
+	}
+	if r.IsSlow {
+		atomic.AddInt64(&h.slow, 1)
+	}
+}
+
+// closeWhenFinished closes the Done channel once every registered host job has completed, and each of the cleanup
+// functions has returned.
+func (h *StreamHandle) closeWhenFinished(cleanup ...func()) {
+	go func() {
+		h.wg.Wait()
+		for _, f := range cleanup {
+			f()
+		}
+		close(h.done)
+	}()
+}
@@ -0,0 +1,41 @@
+package massh
+
+// Handler receives the progress of each host job in a run started with Config.StreamHandler, as an alternative to
+// reading channels. Calls for a single host are never concurrent, and are made in order: OnStart, then OnStdout and
+// OnStderr for each line of output (or chunk, depending on Config.Framing), then OnExit or OnError. OnError is called
+// without OnStart if the job never started. Calls for different hosts may be concurrent.
+//
+// Until OnExit or OnError, only the Result's Host, Job and JobIndex should be used. The host's job is blocked while a
+// call is running, so it's best to return quickly.
+type Handler interface {
+	OnStart(r *Result)
+	OnStdout(r *Result, line []byte)
+	OnStderr(r *Result, line []byte)
+	// OnExit is called when the job's command has exited, successfully or otherwise.
+	OnExit(r *Result)
+	// OnError is called when the job couldn't be run, or didn't run to completion. err is the Result's Error.
+	OnError(r *Result, err error)
+}
+
+// callHandler calls the run's Handler for a step in r's job, if it's using one.
+func (ex *execution) callHandler(conn *hostConnection, t EventType, r *Result, data []byte) {
+	if ex.handler == nil {
+		return
+	}
+
+	conn.handlerMu.Lock()
+	defer conn.handlerMu.Unlock()
+
+	switch t {
+	case HostStarted:
+		ex.handler.OnStart(r)
+	case StdoutLine:
+		ex.handler.OnStdout(r, data)
+	case StderrLine:
+		ex.handler.OnStderr(r, data)
+	case HostExited:
+		ex.handler.OnExit(r)
+	case HostFailed:
+		ex.handler.OnError(r, r.Error)
+	}
+}
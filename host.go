@@ -0,0 +1,172 @@
+package massh
+
+import (
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strings"
+)
+
+// HostConfig overrides the Config's connection parameters for a single host. Empty values are ignored, so only the
+// parameters that differ from the Config need to be set.
+type HostConfig struct {
+	User string
+	// Port is used when the host's entry in Config.Hosts doesn't include a port.
+	Port string
+	// Auth replaces the auth methods of the SSH config used for this host.
+	Auth []ssh.AuthMethod
+
+	// SSHConfig replaces Config.SSHConfig for this host. User and Auth are applied on top of it.
+	SSHConfig *ssh.ClientConfig
+}
+
+// hostTarget is the resolved address and SSH config for a host.
+type hostTarget struct {
+	addr      string // host:port, ready to be dialed.
+	sshConfig *ssh.ClientConfig
+
+	// The jump hosts to connect through, in order, if the ssh config file specifies a ProxyJump.
+	jumps []*hostTarget
+}
+
+// JumpHost is a single hop in a chain of bastions, see Config.JumpHosts.
+type JumpHost struct {
+	// Host may include a port, in the same forms as Config.Hosts.
+	Host string
+	// Port is used when Host doesn't include a port. Port 22 is used if neither is set.
+	Port string
+	// SSHConfig for this hop. If nil, BastionHostSSHConfig is used, or SSHConfig if that is also nil.
+	SSHConfig *ssh.ClientConfig
+}
+
+// splitHostPort separates an entry in Config.Hosts into it's address and port. Accepted forms are "host",
+// "host:port", "[ipv6]:port", "[ipv6]" and a bare IPv6 address. port is empty if the entry doesn't include one.
+func splitHostPort(host string) (addr string, port string) {
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		return h, p
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), ""
+}
+
+// resolveHost combines the host's entry in Config.Hosts with any HostConfig, the ssh config file, and the Config
+// defaults, in that order of precedence.
+func resolveHost(host string, config *Config) (*hostTarget, error) {
+	addr, port := splitHostPort(host)
+
+	sshConf := config.SSHConfig
+	hc := config.HostConfigs[host]
+	if hc != nil && hc.SSHConfig != nil {
+		sshConf = hc.SSHConfig
+	}
+	// Copy, so we never modify a config that may be shared with other hosts.
+	c := *sshConf
+
+	var userSet, authSet bool
+	if hc != nil {
+		if port == "" {
+			port = hc.Port
+		}
+		if hc.User != "" {
+			c.User = hc.User
+			userSet = true
+		}
+		if hc.Auth != nil {
+			c.Auth = hc.Auth
+			authSet = true
+		}
+	}
+
+	target := &hostTarget{sshConfig: &c}
+	if config.sshConfigFile != nil {
+		entry := config.sshConfigFile.lookup(addr)
+		if err := entry.apply(config.sshConfigFile, &addr, &port, &c, !userSet, !authSet); err != nil {
+			return nil, err
+		}
+
+		if entry.ProxyJump != "" && entry.ProxyJump != "none" {
+			jumps, err := resolveProxyJump(entry.ProxyJump, config)
+			if err != nil {
+				return nil, err
+			}
+			target.jumps = jumps
+		}
+	}
+	if port == "" {
+		port = sshPort
+	}
+	target.addr = net.JoinHostPort(addr, port)
+
+	return target, nil
+}
+
+// resolveJumpHosts returns the jump hosts set in the Config, either as JumpHosts, or a single BastionHost. It returns
+// nil if neither is set.
+func resolveJumpHosts(config *Config) ([]*hostTarget, error) {
+	jumpHosts := config.JumpHosts
+	if len(jumpHosts) == 0 && config.BastionHost != "" {
+		jumpHosts = []JumpHost{{Host: config.BastionHost}}
+	}
+
+	var jumps []*hostTarget
+	for _, jh := range jumpHosts {
+		addr, port := splitHostPort(jh.Host)
+		if port == "" {
+			port = jh.Port
+		}
+
+		sshConf := jh.SSHConfig
+		if sshConf == nil {
+			sshConf = config.bastionSSHConfig()
+		}
+
+		j, err := resolveJumpHost(addr, port, "", sshConf, jh.SSHConfig == nil, config)
+		if err != nil {
+			return nil, err
+		}
+		jumps = append(jumps, j)
+	}
+	return jumps, nil
+}
+
+// resolveProxyJump resolves a ProxyJump value; a comma separated list of hops in the form [user@]host[:port].
+func resolveProxyJump(proxyJump string, config *Config) ([]*hostTarget, error) {
+	var jumps []*hostTarget
+	for _, hop := range strings.Split(proxyJump, ",") {
+		hop = strings.TrimSpace(hop)
+
+		var user string
+		if i := strings.LastIndex(hop, "@"); i >= 0 {
+			user, hop = hop[:i], hop[i+1:]
+		}
+		addr, port := splitHostPort(hop)
+
+		j, err := resolveJumpHost(addr, port, user, config.bastionSSHConfig(), user == "", config)
+		if err != nil {
+			return nil, err
+		}
+		jumps = append(jumps, j)
+	}
+	return jumps, nil
+}
+
+// resolveJumpHost resolves a single jump host through the ssh config file, if there is one. The file's User option is
+// only used if setUser is true.
+func resolveJumpHost(addr string, port string, user string, sshConf *ssh.ClientConfig, setUser bool, config *Config) (*hostTarget, error) {
+	c := *sshConf
+	if user != "" {
+		c.User = user
+	}
+	if config.sshConfigFile != nil {
+		entry := config.sshConfigFile.lookup(addr)
+		if err := entry.apply(config.sshConfigFile, &addr, &port, &c, setUser, true); err != nil {
+			return nil, err
+		}
+	}
+	if port == "" {
+		port = sshPort
+	}
+
+	return &hostTarget{
+		addr:      net.JoinHostPort(addr, port),
+		sshConfig: &c,
+	}, nil
+}
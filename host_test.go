@@ -0,0 +1,220 @@
+package massh
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitHostPort(t *testing.T) {
+	tests := []struct {
+		host string
+		addr string
+		port string
+	}{
+		{"host1", "host1", ""},
+		{"host1:2222", "host1", "2222"},
+		{"192.168.1.1", "192.168.1.1", ""},
+		{"192.168.1.1:2222", "192.168.1.1", "2222"},
+		{"[::1]:2222", "::1", "2222"},
+		{"[::1]", "::1", ""},
+		{"fe80::1", "fe80::1", ""},
+	}
+
+	for _, tt := range tests {
+		addr, port := splitHostPort(tt.host)
+		if addr != tt.addr || port != tt.port {
+			t.Errorf("splitHostPort(%q) = %q, %q, expected %q, %q", tt.host, addr, port, tt.addr, tt.port)
+		}
+	}
+}
+
+func TestResolveHost(t *testing.T) {
+	override := &ssh.ClientConfig{User: "overrideUser"}
+	config := &Config{
+		SSHConfig: &ssh.ClientConfig{User: "defaultUser"},
+		HostConfigs: map[string]*HostConfig{
+			"host2":      {Port: "2222", User: "host2User"},
+			"host3:2200": {Port: "2222"},
+			"host4":      {SSHConfig: override},
+		},
+	}
+
+	tests := []struct {
+		host string
+		addr string
+		user string
+	}{
+		{"host1", "host1:22", "defaultUser"},
+		{"host2", "host2:2222", "host2User"},
+		{"host3:2200", "host3:2200", "defaultUser"},
+		{"host4", "host4:22", "overrideUser"},
+		{"::1", "[::1]:22", "defaultUser"},
+	}
+
+	for _, tt := range tests {
+		target, err := resolveHost(tt.host, config)
+		if err != nil {
+			t.Errorf("Unexpected error resolving %q: %s", tt.host, err)
+			continue
+		}
+		if target.addr != tt.addr {
+			t.Errorf("Unexpected address for %q.\nGot: %s\nExpected: %s\n", tt.host, target.addr, tt.addr)
+		}
+		if target.sshConfig.User != tt.user {
+			t.Errorf("Unexpected user for %q.\nGot: %s\nExpected: %s\n", tt.host, target.sshConfig.User, tt.user)
+		}
+	}
+
+	// Overrides must never leak into shared configs.
+	if config.SSHConfig.User != "defaultUser" || override.User != "overrideUser" {
+		t.Errorf("Shared SSH config was modified while resolving hosts")
+	}
+}
+
+func TestResolveJumpHosts(t *testing.T) {
+	bastionConfig := &ssh.ClientConfig{User: "bastionUser"}
+	hopConfig := &ssh.ClientConfig{User: "hopUser"}
+	config := &Config{
+		SSHConfig:            &ssh.ClientConfig{User: "defaultUser"},
+		BastionHost:          "ignored",
+		BastionHostSSHConfig: bastionConfig,
+		JumpHosts: []JumpHost{
+			{Host: "jump1"},
+			{Host: "jump2", Port: "2222", SSHConfig: hopConfig},
+			{Host: "[::1]:2200"},
+		},
+	}
+
+	jumps, err := resolveJumpHosts(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := []struct {
+		addr string
+		user string
+	}{
+		{"jump1:22", "bastionUser"},
+		{"jump2:2222", "hopUser"},
+		{"[::1]:2200", "bastionUser"},
+	}
+	if len(jumps) != len(expected) {
+		t.Fatalf("Expected %d jump hosts, got %d", len(expected), len(jumps))
+	}
+	for i := range expected {
+		if jumps[i].addr != expected[i].addr || jumps[i].sshConfig.User != expected[i].user {
+			t.Errorf("Unexpected jump host %d: %s@%s", i, jumps[i].sshConfig.User, jumps[i].addr)
+		}
+	}
+
+	// BastionHost is used as a single hop if there are no JumpHosts.
+	config.JumpHosts = nil
+	jumps, err = resolveJumpHosts(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(jumps) != 1 || jumps[0].addr != "ignored:22" {
+		t.Errorf("Expected BastionHost to be used as a single hop, got %d jump hosts", len(jumps))
+	}
+}
+
+func TestResolveHostIdentityFile(t *testing.T) {
+	existing := testSigner(t)
+	identity := testSigner(t)
+
+	keyFile := filepath.Join(t.TempDir(), "id_ecdsa")
+	if err := ioutil.WriteFile(keyFile, identity.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := parseSSHConfig(strings.NewReader("Host *\n    IdentityFile " + keyFile + "\n"))
+	if err != nil {
+		t.Fatalf("Unexpected parse error: %s", err)
+	}
+
+	config := &Config{
+		SSHConfig: &ssh.ClientConfig{
+			User: "defaultUser",
+			Auth: []ssh.AuthMethod{
+				newPublicKeyAuth(func() ([]ssh.Signer, error) { return []ssh.Signer{existing.signer}, nil }),
+				ssh.Password("password"),
+			},
+		},
+		sshConfigFile: f,
+	}
+
+	target, err := resolveHost("host1", config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Both keys must be in a single publickey method, as only the first one is ever attempted.
+	auth := target.sshConfig.Auth
+	if len(auth) != 2 {
+		t.Fatalf("Expected a combined publickey method and a password method, got %d methods", len(auth))
+	}
+	pk, ok := auth[0].(*publicKeyAuth)
+	if !ok {
+		t.Fatalf("Expected the first method to be the combined publickey method, got %T", auth[0])
+	}
+	signers, err := pk.signers()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(signers) != 2 || !bytes.Equal(signers[0].PublicKey().Marshal(), identity.signer.PublicKey().Marshal()) ||
+		!bytes.Equal(signers[1].PublicKey().Marshal(), existing.signer.PublicKey().Marshal()) {
+		t.Errorf("Expected the identity file's key followed by the existing key, got %d keys", len(signers))
+	}
+	if len(config.SSHConfig.Auth) != 2 {
+		t.Errorf("Shared SSH config was modified while resolving hosts")
+	}
+
+	// Keys added directly can't be combined, so they're kept in place of the identity file, rather than never tried.
+	for _, method := range []ssh.AuthMethod{
+		ssh.PublicKeys(existing.signer),
+		ssh.PublicKeysCallback(func() ([]ssh.Signer, error) { return []ssh.Signer{existing.signer}, nil }),
+	} {
+		config.SSHConfig.Auth = []ssh.AuthMethod{method}
+		target, err = resolveHost("host1", config)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if auth := target.sshConfig.Auth; len(auth) != 1 || reflect.TypeOf(auth[0]) != reflect.TypeOf(method) {
+			t.Errorf("Expected the caller's publickey method to be left alone, got %d methods", len(auth))
+		}
+	}
+}
+
+type testKey struct {
+	signer ssh.Signer
+	pem    []byte
+}
+
+// testSigner generates a key for tests, along with it's PEM encoding.
+func testSigner(t *testing.T) testKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{
+		signer: signer,
+		pem:    pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+	}
+}
@@ -1,5 +1,19 @@
 package massh
 
+// JobStackPolicy controls what happens to the remaining jobs once a job fails. A job fails when it's
+// Result doesn't report Success().
+type JobStackPolicy int
+
+const (
+	// ContinueOnFailure runs every job on every host, regardless of the outcome of previous jobs. This is the default.
+	ContinueOnFailure JobStackPolicy = iota
+	// StopHostOnFailure skips the remaining jobs on a host once one of it's jobs has failed. Other hosts are unaffected.
+	StopHostOnFailure
+	// AbortRunOnFailure stops the whole run once any job fails. Running jobs are cancelled with ErrRunAborted, and
+	// jobs that haven't started are skipped. The run is halted with ErrRunAborted.
+	AbortRunOnFailure
+)
+
 // Job is a single remote task config. For script files, use Job.SetLocalScript().
 type Job struct {
 	Command string
@@ -0,0 +1,180 @@
+package massh
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"sync"
+)
+
+// HostKeyError is returned, wrapped in Result.Error, when a host's key is rejected by a callback created with
+// KnownHostsCallback or TrustOnFirstUseCallback.
+type HostKeyError struct {
+	Hostname string        // The address being connected to, as host:port.
+	Key      ssh.PublicKey // The key presented by the host.
+	// Want contains the host's known keys. If it's empty, and the key wasn't revoked, the host is unknown.
+	Want    []knownhosts.KnownKey
+	Revoked bool // The key presented by the host was marked @revoked.
+
+	Err error // The underlying *knownhosts.KeyError or *knownhosts.RevokedError.
+}
+
+func (e *HostKeyError) Error() string {
+	switch {
+	case e.Revoked:
+		return fmt.Sprintf("host key for %s is revoked", e.Hostname)
+	case e.Unknown():
+		return fmt.Sprintf("host key for %s is unknown", e.Hostname)
+	}
+	return fmt.Sprintf("host key mismatch for %s, got %s key %s", e.Hostname, e.Key.Type(), ssh.FingerprintSHA256(e.Key))
+}
+
+func (e *HostKeyError) Unwrap() error {
+	return e.Err
+}
+
+// Unknown reports whether the host wasn't found in any known_hosts file. Otherwise, the host presented a key that
+// didn't match, which may indicate a man-in-the-middle attack.
+func (e *HostKeyError) Unknown() bool {
+	return len(e.Want) == 0 && !e.Revoked
+}
+
+// KnownHostsCallback returns a strict HostKeyCallback that only accepts hosts whose keys are present in one of the
+// known_hosts files. Hashed hostnames, @cert-authority and @revoked lines are supported.
+//
+// Rejected keys are reported as a *HostKeyError, which can be found in Result.Error using errors.As.
+func KnownHostsCallback(files ...string) (ssh.HostKeyCallback, error) {
+	paths := make([]string, len(files))
+	for i := range files {
+		paths[i] = expandHome(files[i])
+	}
+
+	cb, err := knownhosts.New(paths...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load known_hosts: %s", err)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return hostKeyError(hostname, key, cb(hostname, remote, key))
+	}, nil
+}
+
+// TrustOnFirstUseCallback returns a HostKeyCallback that accepts and records the key of any host that isn't present in
+// file, or in any of the additional read-only files. Hosts that are already known must present a matching key, and
+// are otherwise rejected with a *HostKeyError.
+//
+// New keys are appended to file, which is created if it doesn't exist.
+func TrustOnFirstUseCallback(file string, files ...string) (ssh.HostKeyCallback, error) {
+	file = expandHome(file)
+
+	// knownhosts.New requires every file to exist.
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open known_hosts: %s", err)
+	}
+	f.Close()
+
+	known, err := KnownHostsCallback(append([]string{file}, files...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tofu{
+		file:    file,
+		known:   known,
+		trusted: map[string]ssh.PublicKey{},
+	}
+	return t.callback, nil
+}
+
+// tofu records the keys of unknown hosts. Keys written during this process are tracked in trusted, as the
+// known_hosts files are only read once.
+type tofu struct {
+	file  string
+	known ssh.HostKeyCallback
+
+	mu      sync.Mutex
+	trusted map[string]ssh.PublicKey
+}
+
+func (t *tofu) callback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	err := t.known(hostname, remote, key)
+
+	var hkErr *HostKeyError
+	if !errors.As(err, &hkErr) || !hkErr.Unknown() {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Normalize, so that the entry matches knownhosts' own lookups. For example, port 22 is omitted.
+	address := knownhosts.Normalize(hostname)
+	if trusted, ok := t.trusted[address]; ok {
+		if string(trusted.Marshal()) != string(key.Marshal()) {
+			return &HostKeyError{
+				Hostname: hostname,
+				Key:      key,
+				Want:     []knownhosts.KnownKey{{Key: trusted, Filename: t.file}},
+				Err:      &knownhosts.KeyError{Want: []knownhosts.KnownKey{{Key: trusted, Filename: t.file}}},
+			}
+		}
+		return nil
+	}
+
+	f, err := os.OpenFile(t.file, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to record host key: %s", err)
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{address}, key)); err != nil {
+		return fmt.Errorf("unable to record host key: %s", err)
+	}
+	t.trusted[address] = key
+
+	return nil
+}
+
+// hostKeyError converts errors from a knownhosts callback into a *HostKeyError.
+func hostKeyError(hostname string, key ssh.PublicKey, err error) error {
+	switch e := err.(type) {
+	case *knownhosts.KeyError:
+		return &HostKeyError{Hostname: hostname, Key: key, Want: e.Want, Err: e}
+	case *knownhosts.RevokedError:
+		return &HostKeyError{Hostname: hostname, Key: key, Revoked: true, Err: e}
+	}
+	return err
+}
+
+// SetKnownHosts sets a strict HostKeyCallback for SSHConfig, and BastionHostSSHConfig if it's set, using
+// KnownHostsCallback.
+func (c *Config) SetKnownHosts(files ...string) error {
+	cb, err := KnownHostsCallback(files...)
+	if err != nil {
+		return err
+	}
+	c.setHostKeyCallbacks(cb)
+	return nil
+}
+
+// SetKnownHostsTrustOnFirstUse sets a trust-on-first-use HostKeyCallback for SSHConfig, and BastionHostSSHConfig if
+// it's set, using TrustOnFirstUseCallback.
+func (c *Config) SetKnownHostsTrustOnFirstUse(file string, files ...string) error {
+	cb, err := TrustOnFirstUseCallback(file, files...)
+	if err != nil {
+		return err
+	}
+	c.setHostKeyCallbacks(cb)
+	return nil
+}
+
+func (c *Config) setHostKeyCallbacks(cb ssh.HostKeyCallback) {
+	c.SSHConfig.HostKeyCallback = cb
+	if c.BastionHostSSHConfig != nil {
+		c.BastionHostSSHConfig.HostKeyCallback = cb
+	}
+}
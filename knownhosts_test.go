@@ -0,0 +1,125 @@
+package massh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testRemoteAddr = &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 22}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func writeKnownHosts(t *testing.T, lines ...string) string {
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	if err := ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestKnownHostsCallback(t *testing.T) {
+	host1 := newTestSigner(t).PublicKey()
+	host2 := newTestSigner(t).PublicKey()
+	other := newTestSigner(t).PublicKey()
+
+	// CA signed host certificate for host3.
+	ca := newTestSigner(t)
+	cert := &ssh.Certificate{
+		Key:             newTestSigner(t).PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"host3"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	file := writeKnownHosts(t,
+		knownhosts.Line([]string{"host1"}, host1),
+		knownhosts.Line([]string{knownhosts.HashHostname("host2")}, host2),
+		"@cert-authority *.example.com,host3 "+strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca.PublicKey()))),
+	)
+
+	cb, err := KnownHostsCallback(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cb("host1:22", testRemoteAddr, host1); err != nil {
+		t.Errorf("Expected host1 to be accepted, got: %s", err)
+	}
+	if err := cb("host2:22", testRemoteAddr, host2); err != nil {
+		t.Errorf("Expected hashed host2 to be accepted, got: %s", err)
+	}
+
+	certChecker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return string(auth.Marshal()) == string(ca.PublicKey().Marshal())
+		},
+		HostKeyFallback: cb,
+	}
+	if err := certChecker.CheckHostKey("host3:22", testRemoteAddr, cert); err != nil {
+		t.Errorf("Expected host3 certificate to be accepted, got: %s", err)
+	}
+
+	var hkErr *HostKeyError
+	if err := cb("host1:22", testRemoteAddr, other); !errors.As(err, &hkErr) || hkErr.Unknown() {
+		t.Errorf("Expected a host key mismatch, got: %v", err)
+	}
+	if err := cb("unknown:22", testRemoteAddr, other); !errors.As(err, &hkErr) || !hkErr.Unknown() {
+		t.Errorf("Expected an unknown host key, got: %v", err)
+	}
+}
+
+func TestTrustOnFirstUseCallback(t *testing.T) {
+	key := newTestSigner(t).PublicKey()
+	other := newTestSigner(t).PublicKey()
+
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	cb, err := TrustOnFirstUseCallback(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cb("host1:22", testRemoteAddr, key); err != nil {
+		t.Errorf("Expected first use to be accepted, got: %s", err)
+	}
+	if err := cb("host1:22", testRemoteAddr, key); err != nil {
+		t.Errorf("Expected second use to be accepted, got: %s", err)
+	}
+
+	var hkErr *HostKeyError
+	if err := cb("host1:22", testRemoteAddr, other); !errors.As(err, &hkErr) || hkErr.Unknown() {
+		t.Errorf("Expected a host key mismatch, got: %v", err)
+	}
+
+	// The key must have been recorded, so a new callback will also reject a mismatch.
+	strict, err := KnownHostsCallback(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := strict("host1:22", testRemoteAddr, key); err != nil {
+		t.Errorf("Expected recorded key to be accepted, got: %s", err)
+	}
+	if err := strict("host1:22", testRemoteAddr, other); !errors.As(err, &hkErr) {
+		t.Errorf("Expected a host key mismatch, got: %v", err)
+	}
+}
@@ -5,35 +5,98 @@
 package massh
 
 import (
+	"context"
 	"fmt"
 	"github.com/mitchellh/go-homedir"
 	"golang.org/x/crypto/ssh"
 	"io/ioutil"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Config is a collection of parameters for running distributed SSH commands. A new config should always be generated
 // using NewConfig.
 type Config struct {
+	// Hosts may be in the form "host", "host:port", or "[ipv6]:port". Port 22 is used if one isn't specified.
 	Hosts     map[string]struct{}
 	SSHConfig *ssh.ClientConfig
 
+	// Per-host overrides of SSHConfig and port, keyed by the host's entry in Hosts.
+	HostConfigs map[string]*HostConfig
+
 	// Jobs to execute, config will error if both are set
 	Job      *Job
 	JobStack *[]Job
 
+	// What to do when a job fails. Skipped jobs don't produce a Result. Defaults to ContinueOnFailure.
+	JobStackPolicy JobStackPolicy
+
 	// Number of concurrent workers
 	WorkerPool int
 
+	// Maximum time a host may take to connect and run all of it's jobs. No limit if zero.
+	HostTimeout time.Duration
+	// Maximum time a single job may run for. No limit if zero.
+	JobTimeout time.Duration
+
+	// Signal sent to the remote command when a host is cancelled or stopped, or HostTimeout or JobTimeout is reached.
+	// The connection is closed if the command hasn't exited after StopGrace, which defaults to 5 seconds. If empty,
+	// the connection is closed straight away.
+	StopSignal ssh.Signal
+	StopGrace  time.Duration
+	// Request a pseudo-terminal for each job, so that servers hang up the remote command when the connection is
+	// closed. Stdout and stderr are combined by the terminal, and are both read from stdout.
+	RequestPTY bool
+
+	// Retry failed connections and sessions. If nil, failures aren't retried.
+	Retry *RetryPolicy
+
+	// Hosts to run before the rest, which only run if the canaries succeed. If nil, there is no canary phase.
+	Canary *CanaryConfig
+	// Run hosts in batches, halting once too many hosts have failed. If nil, every host is run at once.
+	Rolling *RollingConfig
+
 	BastionHost string
 	// BastionHost's SSH config. If nil, Bastion will use SSHConfig instead.
 	BastionHostSSHConfig *ssh.ClientConfig
 
+	// Ordered chain of bastions to connect through, the first being dialed directly. Takes precedence over BastionHost.
+	JumpHosts []JumpHost
+
+	// Maximum number of connections to each bastion, shared by every host in a run. Defaults to 1.
+	BastionPoolSize int
+
+	// Set by LoadSSHConfigFile.
+	sshConfigFile *sshConfigFile
+
+	// Run-only. Populate Result.Interleaved with stdout and stderr lines in the order they were received.
+	InterleaveOutput bool
+
 	// Stream-only
-	SlowTimeout     int  // Timeout for declaring that a host is slow.
-	CancelSlowHosts bool // Not implemented. Automatically cancel hosts that are flagged as slow.
-	Stop            chan struct{}
+	SlowTimeout     time.Duration // Timeout for declaring that a host is slow. Slow detection is disabled if zero.
+	CancelSlowHosts bool          // Automatically cancel hosts that are flagged as slow. Requires SlowTimeout.
+	// Receives a SlowEvent when a host goes quiet, and again when it recovers. Events that haven't been received
+	// by the time the host's job completes are dropped, so the channel should be buffered or read promptly.
+	SlowEvents chan<- SlowEvent
+	// Number of times a host cancelled for being slow is run again, after the hosts already in the queue.
+	SlowHostRequeues int
+	// How output is split up before it's streamed, which is one line at a time by default. MaxChunkSize is the largest
+	// chunk sent when using FrameChunks, and defaults to 32KiB.
+	Framing      Framing
+	MaxChunkSize int
+	// Number of lines, or chunks, of output that can be waiting to be read from StdOutStream and StdErrStream each
+	// before Overflow applies. Nothing waits by default, and at least 1 can when Overflow isn't OverflowBlock.
+	StreamBufferSize int
+	Overflow         OverflowPolicy
+
+	// Sending to Stop stops a single run that's in progress. Use StopAllSessions to stop every run.
+	Stop chan struct{}
+
+	// Runs in progress, so they can be stopped by StopAllSessions.
+	mu     sync.Mutex
+	active map[*execution]struct{}
 }
 
 // NewConfig initialises a new Config.
@@ -41,6 +104,7 @@ func NewConfig() *Config {
 	return &Config{
 		Hosts:                map[string]struct{}{},
 		SSHConfig:            &ssh.ClientConfig{},
+		HostConfigs:          map[string]*HostConfig{},
 		BastionHostSSHConfig: &ssh.ClientConfig{},
 		Stop:                 make(chan struct{}, 1),
 	}
@@ -52,10 +116,25 @@ func NewConfig() *Config {
 // execution is not affected by SlowTimeout or CancelSlowHosts. The Results returned using this method
 // always have an IsSlow value of false.
 func (c *Config) Run() ([]Result, error) {
-	if err := checkJobs(c); err != nil {
+	return c.RunContext(context.Background())
+}
+
+// RunContext is Run, but cancelling ctx, or reaching it's deadline, will close the SSH connection of every host that
+// is still running. Hosts that have not yet started will return a Result with ctx's error.
+//
+// Stopping the run with StopAllSessions or Config.Stop is different, as hosts that have not yet started are skipped,
+// and don't return a Result. ErrStopped is returned along with the results of the hosts that did run.
+//
+// Results are returned in the order they completed. When using a JobStackPolicy other than ContinueOnFailure, there
+// may be fewer results than hosts multiplied by jobs, as skipped jobs don't produce a Result.
+//
+// If the run is halted by a failed canary, a rolling run's failure threshold or AbortRunOnFailure, ErrCanaryFailed,
+// ErrFailureThresholdExceeded or ErrRunAborted is returned along with the results of the hosts that did run.
+func (c *Config) RunContext(ctx context.Context) ([]Result, error) {
+	if err := checkRun(c); err != nil {
 		return nil, err
 	}
-	return run(c), nil
+	return run(ctx, c)
 }
 
 /*
@@ -64,41 +143,96 @@ real-time output processing and premature cancellation.
 
 Stdout and Stderr can be read from StdOutStream and StdErrStream respectively.
 
+If a host is cancelled before it's Result has been received from rs, the Result is dropped, so a cancelled run never
+waits for rs to be read.
+
+The returned StreamHandle reports when every host has completed, as well as counters for the run's progress. If the
+run is halted early, StreamHandle.Err() reports the reason, such as ErrCanaryFailed, ErrFailureThresholdExceeded or
+ErrRunAborted.
+
 Example for reading each result in the channel:
 ```
 resultChan := make(chan *Result)
-cfg.Stream(resultChan)
+handle, err := cfg.Stream(resultChan)
+
 	for {
-		result := <-resultChan
-		go func() {
-			// do something with the result
-		}()
+		select {
+		case result := <-resultChan:
+			go func() {
+				// do something with the result
+			}()
+		case <-handle.Done():
+			return
+		}
 	}
+
 ```
 
 More complete examples can be found in test files or in _examples.
 */
-func (c *Config) Stream(rs chan *Result) error {
-	if err := checkJobs(c); err != nil {
-		return err
+func (c *Config) Stream(rs chan *Result) (*StreamHandle, error) {
+	return c.StreamContext(context.Background(), rs)
+}
+
+// StreamContext is Stream, but cancelling ctx, or reaching it's deadline, will close the SSH connection of every host
+// that is still running. An individual host can be cancelled with Result.Cancel().
+func (c *Config) StreamContext(ctx context.Context, rs chan *Result) (*StreamHandle, error) {
+	if err := checkRun(c); err != nil {
+		return nil, err
 	}
 
 	if rs == nil {
-		return fmt.Errorf("stream channel cannot be nil")
+		return nil, fmt.Errorf("stream channel cannot be nil")
 	}
 
-	runStream(c, rs)
-	return nil
+	return runStream(ctx, c, rs), nil
 }
 
-// SetPrivateKeyAuth takes the private key file provided, reads it, and adds the key signature to the config.
-func (c *Config) SetPrivateKeyAuth(PrivateKeyFile string, PrivateKeyPassphrase string) error {
-	if strings.HasPrefix(PrivateKeyFile, "~/") {
-		home, _ := homedir.Dir()
-		PrivateKeyFile = filepath.Join(home, PrivateKeyFile[2:])
+// StreamHandler is an alternative to Stream, calling h with each host's progress and output rather than writing to
+// channels. See Handler for the order calls are made in.
+//
+// The returned StreamHandle reports when every host has completed, as it does for Stream.
+func (c *Config) StreamHandler(h Handler) (*StreamHandle, error) {
+	return c.StreamHandlerContext(context.Background(), h)
+}
+
+// StreamHandlerContext is StreamHandler, but cancelling ctx, or reaching it's deadline, will close the SSH connection
+// of every host that is still running.
+func (c *Config) StreamHandlerContext(ctx context.Context, h Handler) (*StreamHandle, error) {
+	if err := checkRun(c); err != nil {
+		return nil, err
+	}
+
+	if h == nil {
+		return nil, fmt.Errorf("stream handler cannot be nil")
+	}
+
+	return runHandler(ctx, c, h), nil
+}
+
+// Events is an alternative to Stream, reporting the run's progress on a single channel of events rather than a
+// channel of Results, each with their own output channels. Events are sent in the order they happened. For each host
+// job, that's HostConnecting (for the host's first job), HostStarted, it's StdoutLine and StderrLine events, then
+// HostExited or HostFailed. RunFinished is always the last event, after which the channel is closed.
+//
+// The channel must be read until it's closed, otherwise the run is blocked until it is. Skipped jobs don't send any
+// events.
+func (c *Config) Events() (<-chan Event, error) {
+	return c.EventsContext(context.Background())
+}
+
+// EventsContext is Events, but cancelling ctx, or reaching it's deadline, will close the SSH connection of every host
+// that is still running. Cancelled hosts still send HostFailed, and RunFinished is still sent.
+func (c *Config) EventsContext(ctx context.Context) (<-chan Event, error) {
+	if err := checkRun(c); err != nil {
+		return nil, err
 	}
+	return runEvents(ctx, c), nil
+}
 
-	key, err := ioutil.ReadFile(PrivateKeyFile)
+// SetPrivateKeyAuth takes the private key file provided, reads it, and adds the key signature to the config.
+func (c *Config) SetPrivateKeyAuth(PrivateKeyFile string, PrivateKeyPassphrase string) error {
+	key, err := ioutil.ReadFile(expandHome(PrivateKeyFile))
 	if err != nil {
 		return fmt.Errorf("unable to read private key file: %s", err)
 	}
@@ -119,11 +253,22 @@ func (c *Config) SetPrivateKeyAuth(PrivateKeyFile string, PrivateKeyPassphrase s
 		}
 	}
 
-	c.SSHConfig.Auth = append(c.SSHConfig.Auth, ssh.PublicKeys(signer))
+	c.SSHConfig.Auth = append(c.SSHConfig.Auth, newPublicKeyAuth(func() ([]ssh.Signer, error) {
+		return []ssh.Signer{signer}, nil
+	}))
 
 	return nil
 }
 
+// expandHome replaces a leading "~/" in path with the user's home directory.
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		home, _ := homedir.Dir()
+		return filepath.Join(home, path[2:])
+	}
+	return path
+}
+
 // SetPasswordAuth sets ssh password from provided byte slice (read from terminal)
 func (c *Config) SetPasswordAuth(username string, password string) {
 	c.SSHConfig.User = username
@@ -131,10 +276,16 @@ func (c *Config) SetPasswordAuth(username string, password string) {
 }
 
 // SetSlowTimeout sets the SlowTimeout value for config.
-func (c *Config) SetSlowTimeout(timeout int) {
+func (c *Config) SetSlowTimeout(timeout time.Duration) {
 	c.SlowTimeout = timeout
 }
 
+// SetSlowEvents sends a SlowEvent to events when a host goes quiet for longer than SlowTimeout, and again when it
+// recovers.
+func (c *Config) SetSlowEvents(events chan<- SlowEvent) {
+	c.SlowEvents = events
+}
+
 // SetHosts adds a slice of strings as hosts to config. It will filter out duplicate hosts.
 func (c *Config) SetHosts(hosts []string) {
 	for i := range hosts {
@@ -142,7 +293,15 @@ func (c *Config) SetHosts(hosts []string) {
 	}
 }
 
-// SetBastionHost sets the bastion host for config.
+// SetHostConfig overrides the connection parameters for host, which should match it's entry in Hosts.
+func (c *Config) SetHostConfig(host string, hc *HostConfig) {
+	if c.HostConfigs == nil {
+		c.HostConfigs = map[string]*HostConfig{}
+	}
+	c.HostConfigs[host] = hc
+}
+
+// SetBastionHost sets the bastion host for config. The host may include a port, as with Hosts.
 func (c *Config) SetBastionHost(host string) {
 	c.BastionHost = host
 }
@@ -152,6 +311,40 @@ func (c *Config) SetBastionHostConfig(s *ssh.ClientConfig) {
 	c.BastionHostSSHConfig = s
 }
 
+// jobs returns the jobs to run on each host, in order.
+func (c *Config) jobs() []*Job {
+	if c.JobStack == nil {
+		return []*Job{c.Job}
+	}
+	jobs := make([]*Job, len(*c.JobStack))
+	for i := range *c.JobStack {
+		jobs[i] = &(*c.JobStack)[i]
+	}
+	return jobs
+}
+
+// bastionSSHConfig returns the SSH config to use when connecting to a bastion.
+func (c *Config) bastionSSHConfig() *ssh.ClientConfig {
+	if c.BastionHostSSHConfig != nil {
+		return c.BastionHostSSHConfig
+	}
+	return c.SSHConfig
+}
+
+// SetJumpHosts sets a chain of bastions to connect through, in the order given, equivalent to OpenSSH's ProxyJump.
+func (c *Config) SetJumpHosts(jumpHosts ...JumpHost) {
+	c.JumpHosts = jumpHosts
+}
+
+// SetBastionPoolSize sets the maximum number of connections to each bastion, which are shared by every host in a run.
+// If size is less than 1, it will be set to 1 instead.
+func (c *Config) SetBastionPoolSize(size int) {
+	if size < 1 {
+		size = 1
+	}
+	c.BastionPoolSize = size
+}
+
 // SetSSHConfig set the SSHConfig for config.
 func (c *Config) SetSSHConfig(s *ssh.ClientConfig) {
 	c.SSHConfig = s
@@ -162,6 +355,49 @@ func (c *Config) SetJob(job *Job) {
 	c.Job = job
 }
 
+// SetJobStackPolicy sets what happens to the remaining jobs once a job fails.
+func (c *Config) SetJobStackPolicy(policy JobStackPolicy) {
+	c.JobStackPolicy = policy
+}
+
+// SetHostTimeout sets the maximum time a host may take to connect and run all of it's jobs.
+func (c *Config) SetHostTimeout(timeout time.Duration) {
+	c.HostTimeout = timeout
+}
+
+// SetJobTimeout sets the maximum time a single job may run for.
+func (c *Config) SetJobTimeout(timeout time.Duration) {
+	c.JobTimeout = timeout
+}
+
+// SetStopSignal sends signal to the remote command when a host is cancelled, stopped or times out, only closing the
+// connection if the command hasn't exited after grace.
+func (c *Config) SetStopSignal(signal ssh.Signal, grace time.Duration) {
+	c.StopSignal = signal
+	c.StopGrace = grace
+}
+
+// EnablePTY requests a pseudo-terminal for each job, so that the remote command is hung up when it's connection is
+// closed, even if the server doesn't support signals.
+func (c *Config) EnablePTY() {
+	c.RequestPTY = true
+}
+
+// SetRetryPolicy retries failed connections and sessions, according to policy.
+func (c *Config) SetRetryPolicy(policy RetryPolicy) {
+	c.Retry = &policy
+}
+
+// SetCanary runs canary hosts before the rest of Hosts, according to canary.
+func (c *Config) SetCanary(canary CanaryConfig) {
+	c.Canary = &canary
+}
+
+// SetRolling runs hosts in batches, according to rolling.
+func (c *Config) SetRolling(rolling RollingConfig) {
+	c.Rolling = &rolling
+}
+
 // SetWorkerPool specifies the number of concurrent workers for config. If numWorkers is less than 1, it will be
 // set to 1 instead.
 func (c *Config) SetWorkerPool(numWorkers int) {
@@ -189,14 +425,41 @@ func (c *Config) SetSSHAuthSock() error {
 
 // SetSSHHostKeyCallback sets the HostKeyCallback for the Config's SSHConfig value.
 //
-// This value should not be set to ssh.InsecureIgnoreHostKey() in production!
+// This value should not be set to ssh.InsecureIgnoreHostKey() in production! See SetKnownHosts and
+// SetKnownHostsTrustOnFirstUse for safer alternatives.
 func (c *Config) SetSSHHostKeyCallback(callback ssh.HostKeyCallback) {
 	c.SSHConfig.HostKeyCallback = callback
 }
 
-// StopAllSessions stops all active streaming jobs.
+// StopAllSessions stops every host in every run that's in progress using this config, and prevents any queued hosts
+// from starting. Stopped hosts report an ErrCancelled, caused by ErrStopped, and queued hosts are skipped. Each
+// stopped run is halted with ErrStopped, which Run returns, and StreamHandle.Err reports. If StopSignal is set, the
+// remote command is sent the signal first.
+//
+// Runs started after StopAllSessions has returned are unaffected.
 func (c *Config) StopAllSessions() {
-	c.Stop <- struct{}{}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ex := range c.active {
+		ex.abort(ErrStopped)
+	}
+}
+
+// addRun registers a run that's in progress.
+func (c *Config) addRun(ex *execution) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active == nil {
+		c.active = map[*execution]struct{}{}
+	}
+	c.active[ex] = struct{}{}
+}
+
+// removeRun forgets a run that has finished.
+func (c *Config) removeRun(ex *execution) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.active, ex)
 }
 
 // CheckSanity ensures config is valid.
@@ -207,7 +470,34 @@ func (c *Config) CheckSanity() error {
 	return nil
 }
 
-// AutoCancelSlowHosts will cancel/terminate slow host sessions.
+// EnableInterleavedOutput populates Result.Interleaved when using Run(), so that stdout and stderr can be read
+// in the order they were written.
+func (c *Config) EnableInterleavedOutput() {
+	c.InterleaveOutput = true
+}
+
+// AutoCancelSlowHosts will cancel/terminate slow host sessions, by closing the host's connection once SlowTimeout is
+// reached. The host's Result.Error will be an ErrCancelled, caused by ErrSlowHost.
 func (c *Config) AutoCancelSlowHosts() {
 	c.CancelSlowHosts = true
 }
+
+// SetSlowHostRequeues sets the number of times a host cancelled for being slow is run again. Every attempt reports
+// it's own Result. Only applies when AutoCancelSlowHosts is enabled.
+func (c *Config) SetSlowHostRequeues(n int) {
+	c.SlowHostRequeues = n
+}
+
+// SetStreamBuffer sets how much output can be waiting to be read from each Result's StdOutStream and StdErrStream, and
+// what happens to output once that's reached.
+func (c *Config) SetStreamBuffer(size int, overflow OverflowPolicy) {
+	c.StreamBufferSize = size
+	c.Overflow = overflow
+}
+
+// SetFraming sets how streamed output is split up before it's sent. maxChunkSize is only used by FrameChunks, and
+// defaults to 32KiB if zero.
+func (c *Config) SetFraming(framing Framing, maxChunkSize int) {
+	c.Framing = framing
+	c.MaxChunkSize = maxChunkSize
+}
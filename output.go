@@ -0,0 +1,107 @@
+package massh
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// OutputStream identifies which of a command's output streams some output was written to.
+type OutputStream int
+
+const (
+	// Stdout is the remote command's standard output.
+	Stdout OutputStream = iota
+	// Stderr is the remote command's standard error.
+	Stderr
+)
+
+func (s OutputStream) String() string {
+	switch s {
+	case Stdout:
+		return "stdout"
+	case Stderr:
+		return "stderr"
+	}
+	return "unknown"
+}
+
+// OutputLine is a single line of output, tagged with the stream it was written to. Data includes the trailing
+// newline, except for a final line that the command didn't terminate.
+type OutputLine struct {
+	Stream OutputStream
+	Data   []byte
+}
+
+// interleavedOutput collects stdout and stderr from a single session into their own buffers, and optionally a
+// combined slice of lines in the order they were received.
+type interleavedOutput struct {
+	mu        sync.Mutex
+	keepLines bool
+	lines     []OutputLine
+	stdout    outputWriter
+	stderr    outputWriter
+}
+
+// outputWriter is the io.Writer for one stream of an interleavedOutput.
+type outputWriter struct {
+	out     *interleavedOutput
+	stream  OutputStream
+	buf     bytes.Buffer
+	partial []byte
+}
+
+func newInterleavedOutput(keepLines bool) *interleavedOutput {
+	o := &interleavedOutput{keepLines: keepLines}
+	o.stdout = outputWriter{out: o, stream: Stdout}
+	o.stderr = outputWriter{out: o, stream: Stderr}
+	return o
+}
+
+// writers returns the writers to be assigned to ssh.Session's Stdout and Stderr.
+func (o *interleavedOutput) writers() (stdout io.Writer, stderr io.Writer) {
+	return &o.stdout, &o.stderr
+}
+
+// finish flushes any unterminated lines. It must only be called once the session has finished writing.
+func (o *interleavedOutput) finish() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.stdout.flush()
+	o.stderr.flush()
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.out.mu.Lock()
+	defer w.out.mu.Unlock()
+
+	w.buf.Write(p)
+	if !w.out.keepLines {
+		return len(p), nil
+	}
+
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(w.partial[:i+1])
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *outputWriter) flush() {
+	if len(w.partial) > 0 {
+		w.emit(w.partial)
+		w.partial = nil
+	}
+}
+
+func (w *outputWriter) emit(line []byte) {
+	l := make([]byte, len(line))
+	copy(l, line)
+	w.out.lines = append(w.out.lines, OutputLine{Stream: w.stream, Data: l})
+}
@@ -0,0 +1,86 @@
+package massh
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy retries connecting to a host, and opening a session on it, when either fails. Remote commands are never
+// retried, regardless of their outcome.
+type RetryPolicy struct {
+	// Total number of attempts, including the first. Retries are disabled if less than 2.
+	MaxAttempts int
+
+	// Delay before the first retry. Defaults to 1 second if zero.
+	InitialBackoff time.Duration
+	// Maximum delay between attempts. If zero, the delay is not capped.
+	MaxBackoff time.Duration
+	// Multiplier applied to the delay after each attempt. Defaults to 2 if less than 1.
+	Multiplier float64
+	// Fraction of each delay, between 0 and 1, that is randomised to avoid every host retrying at once.
+	Jitter float64
+
+	// Retryable reports whether an attempt that failed with err should be retried. If nil, every error is retried
+	// apart from authentication failures, rejected host keys, and cancellation.
+	Retryable func(err error) bool
+}
+
+// shouldRetry reports whether another attempt should be made, after attempts have already failed with err.
+func (p *RetryPolicy) shouldRetry(attempts int, err error) bool {
+	if p == nil || attempts >= p.MaxAttempts {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return retryable(err)
+}
+
+// backoff returns how long to wait after attempts have failed.
+func (p *RetryPolicy) backoff(attempts int) time.Duration {
+	delay := p.InitialBackoff
+	if delay == 0 {
+		delay = time.Second
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	d := float64(delay) * math.Pow(multiplier, float64(attempts-1))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d -= d * math.Min(p.Jitter, 1) * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// wait blocks for the backoff after attempts have failed, returning false if ctx is done first.
+func (p *RetryPolicy) wait(ctx context.Context, attempts int) bool {
+	t := time.NewTimer(p.backoff(attempts))
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retryable is the default RetryPolicy classifier. Authentication failures and rejected host keys won't be fixed by
+// trying again, so they aren't retried.
+func retryable(err error) bool {
+	switch {
+	case errors.Is(err, ErrAuth), errors.Is(err, ErrHostKey), errors.Is(err, ErrCancelled):
+		return false
+	case errors.Is(err, context.DeadlineExceeded):
+		return false
+	}
+	return true
+}
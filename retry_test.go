@@ -0,0 +1,62 @@
+package massh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	p := &RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+	}
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+	}
+	for _, test := range tests {
+		if got := p.backoff(test.attempts); got != test.want {
+			t.Errorf("backoff after %d attempts: got %s, want %s", test.attempts, got, test.want)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := p.backoff(1); got < 50*time.Millisecond || got > 100*time.Millisecond {
+			t.Fatalf("backoff with jitter out of range: %s", got)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{newError(ErrDial, "host:22", errors.New("dial tcp 127.0.0.1:1: connect: connection refused")), true},
+		{newError(ErrSession, "host", errors.New("failed to create session: EOF")), true},
+		{newError(ErrAuth, "host:22", errors.New("ssh: handshake failed: ssh: unable to authenticate")), false},
+		{newError(ErrBastion, "bastion:22", fmt.Errorf("unable to connect to bastion: %w", newError(ErrHostKey, "bastion:22", &HostKeyError{}))), false},
+		{contextError("host", context.Canceled), false},
+		{newError(ErrCancelled, "host", ErrRunAborted), false},
+	}
+	for _, test := range tests {
+		if got := retryable(test.err); got != test.want {
+			t.Errorf("retryable(%q): got %t, want %t", test.err, got, test.want)
+		}
+	}
+
+	var p *RetryPolicy
+	if p.shouldRetry(1, tests[0].err) {
+		t.Errorf("Expected a nil policy to never retry")
+	}
+}
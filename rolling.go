@@ -0,0 +1,167 @@
+package massh
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrFailureThresholdExceeded is returned when a rolling run is halted because too many hosts have failed.
+	ErrFailureThresholdExceeded = errors.New("failure threshold exceeded, remaining batches were not run")
+	// ErrCanaryFailed is returned when a canary's result doesn't pass CanaryConfig.Check, and the remaining hosts were
+	// not run.
+	ErrCanaryFailed = errors.New("canary failed, remaining hosts were not run")
+	// ErrInvalidCanary is returned before a run starts if Config.Canary doesn't select any hosts, or names hosts that
+	// aren't in Hosts, as the run would otherwise go ahead without a canary.
+	ErrInvalidCanary = errors.New("canary config is invalid")
+)
+
+// CanaryConfig runs a set of canary hosts before the rest of Hosts. The remaining hosts are only run if every
+// canary's results pass Check.
+type CanaryConfig struct {
+	// Canary hosts, which must also be present in Hosts.
+	Hosts []string
+	// Number of hosts to use as canaries, taken from the start of the sorted Hosts. Used when Hosts is empty.
+	Count int
+
+	// Check is called with the Result of every job run on a canary. If nil, Result.Success is used. When streaming,
+	// it's called once the job has completed.
+	Check func(r *Result) bool
+}
+
+// passes reports whether r passes the canary's check.
+func (cc *CanaryConfig) passes(r *Result) bool {
+	if cc.Check == nil {
+		return r.Success()
+	}
+	return cc.Check(r)
+}
+
+// check returns an ErrInvalidCanary if the canary wouldn't select any of hosts, or names hosts that aren't in hosts.
+// It's safe to call check on a nil CanaryConfig.
+func (cc *CanaryConfig) check(hosts map[string]struct{}) error {
+	if cc == nil {
+		return nil
+	}
+
+	if len(cc.Hosts) == 0 {
+		if cc.Count < 1 || len(hosts) == 0 {
+			return fmt.Errorf("%w: no canary hosts are selected", ErrInvalidCanary)
+		}
+		return nil
+	}
+
+	var missing []string
+	for _, h := range cc.Hosts {
+		if _, ok := hosts[h]; !ok {
+			missing = append(missing, h)
+		}
+	}
+	if missing != nil {
+		return fmt.Errorf("%w: canary hosts %s are not in Hosts", ErrInvalidCanary, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// canaries splits sorted hosts into the canaries, and the hosts that should run after them.
+func (c *Config) canaries(hosts []string) (canaries []string, remaining []string) {
+	if c.Canary == nil {
+		return nil, hosts
+	}
+
+	if len(c.Canary.Hosts) == 0 {
+		n := c.Canary.Count
+		if n > len(hosts) {
+			n = len(hosts)
+		}
+		if n < 0 {
+			n = 0
+		}
+		return hosts[:n], hosts[n:]
+	}
+
+	isCanary := map[string]bool{}
+	for _, h := range c.Canary.Hosts {
+		if _, ok := c.Hosts[h]; ok && !isCanary[h] {
+			isCanary[h] = true
+			canaries = append(canaries, h)
+		}
+	}
+	for _, h := range hosts {
+		if !isCanary[h] {
+			remaining = append(remaining, h)
+		}
+	}
+	return canaries, remaining
+}
+
+// RollingConfig runs hosts in batches, sorted by their entry in Hosts. Each batch starts once every host in the
+// previous batch has finished, and no more batches are started once the failure threshold has been exceeded.
+//
+// A host has failed if any of it's jobs don't report Success().
+type RollingConfig struct {
+	// Number of hosts in each batch. If zero, BatchPercent is used instead.
+	BatchSize int
+	// Percentage of Hosts in each batch, rounded up. Used when BatchSize is zero.
+	BatchPercent float64
+
+	// Number of failed hosts tolerated across the whole run, before remaining batches are halted. Used when
+	// MaxFailurePercent is zero.
+	MaxFailures int
+	// Percentage of Hosts that may fail before remaining batches are halted.
+	MaxFailurePercent float64
+}
+
+// valid reports whether the batch size and failure threshold are usable.
+func (r *RollingConfig) valid() bool {
+	if r.BatchSize < 0 || r.MaxFailures < 0 {
+		return false
+	}
+	if r.BatchSize == 0 && (r.BatchPercent <= 0 || r.BatchPercent > 100) {
+		return false
+	}
+	return r.MaxFailurePercent >= 0 && r.MaxFailurePercent <= 100
+}
+
+// thresholdExceeded reports whether failed hosts, out of total, is more than the run tolerates.
+func (r *RollingConfig) thresholdExceeded(failed int, total int) bool {
+	if r.MaxFailurePercent > 0 {
+		return float64(failed)*100/float64(total) > r.MaxFailurePercent
+	}
+	return failed > r.MaxFailures
+}
+
+// sortedHosts returns Hosts in a consistent order, so batches are predictable between runs.
+func (c *Config) sortedHosts() []string {
+	hosts := make([]string, 0, len(c.Hosts))
+	for h := range c.Hosts {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// batches splits hosts into batches according to Rolling. Without Rolling, every host is in a single batch.
+func (c *Config) batches(hosts []string) [][]string {
+	if c.Rolling == nil || len(hosts) == 0 {
+		return [][]string{hosts}
+	}
+
+	size := c.Rolling.BatchSize
+	if size == 0 {
+		size = int(math.Ceil(float64(len(hosts)) * c.Rolling.BatchPercent / 100))
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	var batches [][]string
+	for len(hosts) > size {
+		batches = append(batches, hosts[:size])
+		hosts = hosts[size:]
+	}
+	return append(batches, hosts)
+}
@@ -0,0 +1,114 @@
+package massh
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBatches(t *testing.T) {
+	hosts := []string{"a", "b", "c", "d", "e"}
+
+	tests := []struct {
+		rolling *RollingConfig
+		want    [][]string
+	}{
+		{nil, [][]string{{"a", "b", "c", "d", "e"}}},
+		{&RollingConfig{BatchSize: 2}, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}},
+		{&RollingConfig{BatchSize: 10}, [][]string{{"a", "b", "c", "d", "e"}}},
+		{&RollingConfig{BatchPercent: 50}, [][]string{{"a", "b", "c"}, {"d", "e"}}},
+		{&RollingConfig{BatchPercent: 1}, [][]string{{"a"}, {"b"}, {"c"}, {"d"}, {"e"}}},
+	}
+
+	for _, test := range tests {
+		c := &Config{Rolling: test.rolling}
+		if got := c.batches(hosts); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("batches with %+v: got %v, want %v", test.rolling, got, test.want)
+		}
+	}
+}
+
+func TestThresholdExceeded(t *testing.T) {
+	tests := []struct {
+		rolling RollingConfig
+		failed  int
+		want    bool
+	}{
+		{RollingConfig{BatchSize: 1}, 0, false},
+		{RollingConfig{BatchSize: 1}, 1, true},
+		{RollingConfig{BatchSize: 1, MaxFailures: 2}, 2, false},
+		{RollingConfig{BatchSize: 1, MaxFailures: 2}, 3, true},
+		{RollingConfig{BatchSize: 1, MaxFailurePercent: 10}, 1, false},
+		{RollingConfig{BatchSize: 1, MaxFailurePercent: 10}, 2, true},
+	}
+
+	for _, test := range tests {
+		if got := test.rolling.thresholdExceeded(test.failed, 10); got != test.want {
+			t.Errorf("%+v with %d of 10 failed: got %t, want %t", test.rolling, test.failed, got, test.want)
+		}
+	}
+}
+
+func TestCanaries(t *testing.T) {
+	c := &Config{
+		Hosts: map[string]struct{}{"a": {}, "b": {}, "c": {}},
+	}
+	hosts := c.sortedHosts()
+
+	tests := []struct {
+		canary    *CanaryConfig
+		canaries  []string
+		remaining []string
+	}{
+		{nil, nil, []string{"a", "b", "c"}},
+		{&CanaryConfig{Count: 1}, []string{"a"}, []string{"b", "c"}},
+		{&CanaryConfig{Count: 5}, []string{"a", "b", "c"}, []string{}},
+		{&CanaryConfig{Hosts: []string{"c", "c"}}, []string{"c"}, []string{"a", "b"}},
+	}
+
+	for _, test := range tests {
+		c.Canary = test.canary
+		canaries, remaining := c.canaries(hosts)
+		if !reflect.DeepEqual(canaries, test.canaries) || !reflect.DeepEqual(remaining, test.remaining) {
+			t.Errorf("canaries with %+v: got %v and %v, want %v and %v", test.canary, canaries, remaining, test.canaries, test.remaining)
+		}
+	}
+}
+
+func TestCanaryCheck(t *testing.T) {
+	hosts := map[string]struct{}{"a": {}, "b": {}}
+
+	tests := []struct {
+		canary *CanaryConfig
+		valid  bool
+	}{
+		{nil, true},
+		{&CanaryConfig{Count: 1}, true},
+		{&CanaryConfig{Hosts: []string{"b"}}, true},
+		{&CanaryConfig{}, false},
+		{&CanaryConfig{Hosts: []string{"a", "missing"}}, false},
+	}
+
+	for _, test := range tests {
+		err := test.canary.check(hosts)
+		if test.valid && err != nil {
+			t.Errorf("check with %+v: unexpected error: %s", test.canary, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalidCanary) {
+			t.Errorf("check with %+v: expected ErrInvalidCanary, got: %v", test.canary, err)
+		}
+	}
+
+	// A canary that doesn't select anything must stop the run from starting, rather than running every host.
+	c := &Config{
+		Hosts:  hosts,
+		Job:    &Job{Command: "true"},
+		Canary: &CanaryConfig{Hosts: []string{"missing"}},
+	}
+	if _, err := c.Run(); !errors.Is(err, ErrInvalidCanary) {
+		t.Errorf("Expected Run to return ErrInvalidCanary, got: %v", err)
+	}
+	if _, err := c.Stream(make(chan *Result)); !errors.Is(err, ErrInvalidCanary) {
+		t.Errorf("Expected Stream to return ErrInvalidCanary, got: %v", err)
+	}
+}
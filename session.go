@@ -1,39 +1,112 @@
 package massh
 
 import (
-	"bufio"
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh"
-	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var (
-	// NumberOfStreamingHostsCompleted is incremented when a Result's DoneChannel is written to, indicating a host has completed it's work.
-	NumberOfStreamingHostsCompleted int
-)
-
 const (
 	sshPort = "22"
 )
 
+// ErrRunAborted is the Result.Error of jobs that were cancelled because another job failed while using
+// AbortRunOnFailure.
+var ErrRunAborted = errors.New("run aborted after a job failed")
+
 // Result contains usable output from SSH commands.
 type Result struct {
-	Host   string // Hostname
-	Job    string // The command that was run
-	Output []byte
+	Host     string // Hostname
+	Job      string // The command that was run
+	JobIndex int    // Index of the job in Config.JobStack. Always 0 when using Config.Job.
+	Output   []byte
+	Stderr   []byte // Run-specific. When streaming, read from StdErrStream instead.
+
+	// Run-specific. When Config.InterleaveOutput is enabled, contains stdout and stderr lines in the order they were
+	// received.
+	Interleaved []OutputLine
 
 	// Package errors, not output from SSH. Makes the concurrency easier to manage without returning an error.
+	//
+	// Errors are an *Error, whose kind can be checked with errors.Is, for example errors.Is(r.Error, ErrAuth). A
+	// command that exits with a non-zero status is an ErrRemoteExit caused by an *ssh.ExitError, in addition to
+	// ExitCode and ExitSignal being populated.
 	Error error
 
+	// ExitCode is the remote command's exit status. It is -1 when the status is unknown, for example when the host
+	// could not be reached, or the command was terminated without reporting a status.
+	ExitCode int
+	// ExitSignal is the name of the signal that terminated the remote command, without the "SIG" prefix, if any.
+	ExitSignal string
+
+	// How the job was stopped, if it was cancelled or timed out before it completed.
+	StopAction StopAction
+
+	// Number of attempts made to connect and open a session for the job. It's 0 if an earlier job on the same host
+	// had already failed to connect, in which case no more attempts are made.
+	Attempts int
+
 	// Stream-specific
-	IsSlow bool // Activity timeout for StdOut
+	IsSlow bool // No output on StdOut or StdErr for longer than Config.SlowTimeout. Set once the host has completed.
 
+	// Output from the job, one line at a time unless Config.Framing says otherwise. Output is sent in the order it was
+	// received on each stream, but there is no ordering between the two streams. Both must be read until DoneChannel
+	// is written to, otherwise the job is blocked until they are, unless Config.Overflow allows otherwise. Output that
+	// hasn't been sent when the host is cancelled is discarded.
 	StdOutStream chan []byte
 	StdErrStream chan []byte
-	DoneChannel  chan struct{} // Written to when a host completes work. This does not indicate that all output from StdOutStream or StdErrStream has been read and/or processed.
+	// Written to when a host completes work. This only happens once the last line of output has been read from both
+	// StdOutStream and StdErrStream, so nothing more is sent on them afterwards. It has room for the value, and the
+	// host doesn't wait for it's output to be read, so the run can finish before DoneChannel is written to.
+	DoneChannel chan struct{}
+	// Number of lines, or chunks, of output discarded by OverflowDropOldest. Set once the host has completed.
+	Dropped int
+
+	cancel context.CancelFunc
+	// slow is set atomically when the activity timeout is reached, and copied to IsSlow once the host has completed.
+	slow int32
+	// dropped is updated atomically as output is discarded, and copied to Dropped once the host has completed.
+	dropped int64
+}
+
+// Success reports whether the command ran and exited with a zero status.
+func (r *Result) Success() bool {
+	return r.Error == nil && r.ExitCode == 0
+}
+
+// setExitStatus populates ExitCode and ExitSignal from the error returned by ssh.Session.Run or ssh.Session.Wait.
+func (r *Result) setExitStatus(err error) {
+	switch e := err.(type) {
+	case nil:
+		r.ExitCode = 0
+	case *ssh.ExitError:
+		r.ExitCode = e.ExitStatus()
+		r.ExitSignal = e.Signal()
+	default:
+		// Includes *ssh.ExitMissingError; the command has gone, but we don't know how it ended.
+		r.ExitCode = -1
+	}
+}
+
+// commandError returns the error from ssh.Session.Run or ssh.Session.Wait as an *Error.
+func commandError(host string, err error) error {
+	switch err.(type) {
+	case *ssh.ExitError, *ssh.ExitMissingError:
+		return newError(ErrRemoteExit, host, err)
+	}
+	return newError(ErrSession, host, err)
+}
+
+// Cancel tears down the host's SSH connection, without affecting any other host in the run. It is safe to call
+// Cancel more than once, or after the host has completed.
+func (r *Result) Cancel() {
+	if r.cancel != nil {
+		r.cancel()
+	}
 }
 
 // getJob determines the type of job and returns the command string. If type is a local script, then stdin will be populated with the script data and sent/executed on the remote machine.
@@ -47,275 +120,791 @@ func getJob(s *ssh.Session, j *Job) string {
 	return j.Command
 }
 
+// execution is the state shared by every host in a single call to Run or Stream.
+type execution struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	config   *Config
+	bastions *bastionPool
+	// Jobs to run on every host, taken from config when the run starts.
+	jobs []*Job
+
+	// Set atomically when the run is aborted, by a failed job or StopAllSessions. abortErr is the reason, and is
+	// only set once.
+	aborted   int32
+	abortErr  error
+	abortOnce sync.Once
+	// Number of hosts with at least one failed job, updated atomically.
+	failedHosts int64
+	// Set while running canaries, and isn't changed while workers are running.
+	canaryPhase bool
+	// Set atomically when a canary's result doesn't pass the canary check.
+	canaryFailed int32
+
+	// Stream-specific. Only one of results, events and handler is set.
+	results chan *Result
+	events  chan Event
+	handler Handler
+	handle  *StreamHandle
+	// Streamed output that's still being read after it's host has completed.
+	outputs sync.WaitGroup
+}
+
+// newExecution derives the run's context from ctx, and registers the run with c so it can be stopped. The returned
+// execution must be finished once the run has completed.
+func newExecution(ctx context.Context, c *Config) *execution {
+	ctx, cancel := context.WithCancel(ctx)
+	ex := &execution{
+		ctx:      ctx,
+		cancel:   cancel,
+		config:   c,
+		bastions: newBastionPool(c.BastionPoolSize),
+		jobs:     c.jobs(),
+	}
+	c.addRun(ex)
+
+	// Sending to Config.Stop stops a single run.
+	if c.Stop != nil {
+		go func() {
+			select {
+			case <-c.Stop:
+				ex.abort(ErrStopped)
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ex
+}
+
+// finish releases the run's resources once every host has completed. The run's context is only cancelled once the
+// output of every host has been read, as cancelling it abandons any output that hasn't been.
+func (ex *execution) finish() {
+	ex.config.removeRun(ex)
+	ex.bastions.close()
+	go func() {
+		ex.outputs.Wait()
+		ex.cancel()
+	}()
+}
+
+// abort cancels every running host, and prevents any more jobs from starting. Cancelled jobs report an ErrCancelled
+// caused by reason, and reason is returned as the reason the run was halted. Only the first reason is kept if the run
+// is aborted more than once.
+func (ex *execution) abort(reason error) {
+	ex.abortOnce.Do(func() {
+		ex.abortErr = reason
+		// The handle's error must be set before any host jobs are skipped, as that may close it's Done channel.
+		if ex.handle != nil {
+			ex.handle.setErr(reason)
+		}
+		atomic.StoreInt32(&ex.aborted, 1)
+	})
+	ex.cancel()
+}
+
+func (ex *execution) isAborted() bool {
+	return atomic.LoadInt32(&ex.aborted) == 1
+}
+
+// ctxErr returns the reason the host was cancelled as an *Error, or nil if it hasn't been.
+func (ex *execution) ctxErr(conn *hostConnection) error {
+	if conn.ctx.Err() == nil {
+		return nil
+	}
+	if conn.isSlowCancelled() {
+		return newError(ErrCancelled, conn.host, ErrSlowHost)
+	}
+	if ex.isAborted() {
+		return newError(ErrCancelled, conn.host, ex.abortErr)
+	}
+	return contextError(conn.host, conn.ctx.Err())
+}
+
+// jobError returns the error for a job that exited with err, having been stopped for reason.
+func (ex *execution) jobError(conn *hostConnection, reason stopReason, err error) error {
+	switch reason {
+	case stoppedByDeadline:
+		return newError(ErrTimeout, conn.host, errDeadline)
+	case stoppedByCancel:
+		return ex.ctxErr(conn)
+	}
+
+	// A host cancelled just as the job finished will usually fail with an EOF, which isn't very helpful to the caller.
+	if ctxErr := ex.ctxErr(conn); ctxErr != nil && err != nil {
+		return ctxErr
+	}
+	if err != nil {
+		return commandError(conn.host, err)
+	}
+	return nil
+}
+
+// hostConnection is a single host's SSH connection, which is shared by every job that runs on the host.
+type hostConnection struct {
+	host   string
+	ctx    context.Context
+	cancel context.CancelFunc
+	// The time every job on the host must have finished by, from Config.HostTimeout. Zero if there's no limit.
+	deadline time.Time
+
+	client *ssh.Client
+	err    error // Set if the host couldn't be connected to, in which case no more attempts are made.
+
+	// Set atomically when the host is cancelled for being slow.
+	slowCancelled int32
+
+	// Held while calling the run's Handler, so calls for the host are never concurrent.
+	handlerMu sync.Mutex
+}
+
+// newHostConnection prepares a connection to host, which is made when the first session is opened. The connection must
+// be closed once the host's jobs have finished.
+func newHostConnection(ex *execution, host string) *hostConnection {
+	hostCtx, cancel := context.WithCancel(ex.ctx)
+	conn := &hostConnection{
+		host:   host,
+		ctx:    hostCtx,
+		cancel: cancel,
+	}
+	if ex.config.HostTimeout > 0 {
+		conn.deadline = time.Now().Add(ex.config.HostTimeout)
+	}
+	return conn
+}
+
+// newSession opens a session for r's job, connecting to the host first if needed. Failed attempts are retried
+// according to the run's RetryPolicy, and counted in r.Attempts.
+func (conn *hostConnection) newSession(ex *execution, r *Result) (*ssh.Session, error) {
+	// A host that couldn't be connected to has already used up it's attempts.
+	if conn.err != nil {
+		return nil, conn.err
+	}
+	if ctxErr := ex.ctxErr(conn); ctxErr != nil {
+		return nil, ctxErr
+	}
+	if conn.pastDeadline() {
+		return nil, newError(ErrTimeout, conn.host, errDeadline)
+	}
+
+	// Connecting counts towards the host's deadline.
+	ctx := conn.ctx
+	if !conn.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(conn.ctx, conn.deadline)
+		defer cancel()
+	}
+
+	for {
+		r.Attempts++
+		session, err := conn.tryNewSession(ctx, ex)
+		if err == nil {
+			return session, nil
+		}
+		if ctxErr := ex.ctxErr(conn); ctxErr != nil {
+			err = ctxErr
+		}
+
+		if !ex.config.Retry.shouldRetry(r.Attempts, err) || !ex.config.Retry.wait(ctx, r.Attempts) {
+			if conn.client == nil {
+				conn.err = err
+			}
+			return nil, err
+		}
+	}
+}
+
+// tryNewSession makes a single attempt at opening a session, connecting to the host first if needed.
+func (conn *hostConnection) tryNewSession(ctx context.Context, ex *execution) (*ssh.Session, error) {
+	if conn.client == nil {
+		client, err := generateSSHClientWithPotentialBastion(ctx, conn.host, ex.config, ex.bastions)
+		if err != nil {
+			return nil, err
+		}
+		conn.client = client
+	}
+
+	session, err := newClientSession(conn.client)
+	if err != nil {
+		// If the host rejected the session, the connection is still usable. Otherwise, reconnect on the next attempt.
+		if _, ok := err.(*ssh.OpenChannelError); !ok {
+			conn.client.Close()
+			conn.client = nil
+		}
+		return nil, newError(ErrSession, conn.host, fmt.Errorf("failed to create session: %w", err))
+	}
+	return session, nil
+}
+
+// cancelSlow cancels the host because it's been flagged as slow.
+func (conn *hostConnection) cancelSlow() {
+	atomic.StoreInt32(&conn.slowCancelled, 1)
+	conn.cancel()
+}
+
+func (conn *hostConnection) isSlowCancelled() bool {
+	return atomic.LoadInt32(&conn.slowCancelled) == 1
+}
+
+// close tears down the host's connection.
+func (conn *hostConnection) close() {
+	conn.cancel()
+	if conn.client != nil {
+		conn.client.Close()
+	}
+}
+
 // sshCommand runs an SSH task and returns Result only when the command has finished executing.
-func sshCommand(host string, config *Config) Result {
+func sshCommand(ex *execution, conn *hostConnection, job *Job, jobIndex int) Result {
 	var r Result
 
 	// Never return a Result with a blank host
-	r.Host = host
+	r.Host = conn.host
+	r.JobIndex = jobIndex
+	r.ExitCode = -1
+	r.cancel = conn.cancel
 
-	client, err := generateSSHClientWithPotentialBastion(host, config)
+	session, err := conn.newSession(ex, &r)
 	if err != nil {
 		r.Error = err
 		return r
 	}
-	defer client.Close()
-
-	session, err := newClientSession(client)
-	if err != nil {
-		r.Error = fmt.Errorf("failed to create session: %v", err)
-		return r
-	}
 	defer session.Close()
 
 	// Get job string
-	r.Job = getJob(session, config.Job)
+	r.Job = getJob(session, job)
 
 	// run the job
-	var b bytes.Buffer
-	session.Stdout = &b
-	if err := runJob(session, r.Job); err != nil {
-		r.Error = err
+	out := newInterleavedOutput(ex.config.InterleaveOutput)
+	session.Stdout, session.Stderr = out.writers()
+	if err := requestPTY(ex.config, session); err != nil {
+		r.Error = newError(ErrSession, conn.host, err)
 		return r
 	}
-
-	r.Output = b.Bytes()
+	watcher := conn.watchJob(ex, session)
+	err = runJob(session, r.Job)
+	reason := watcher.finish(conn, &r)
+	r.setExitStatus(err)
+
+	// Keep any output, even if the command failed.
+	out.finish()
+	r.Output = out.stdout.buf.Bytes()
+	r.Stderr = out.stderr.buf.Bytes()
+	r.Interleaved = out.lines
+	r.Error = ex.jobError(conn, reason, err)
 
 	return r
 }
 
-func sshCommandStream(host string, config *Config, resultChannel chan *Result) {
+// sshCommandStream runs job, streaming it's output to the result's channels, or reporting it as events or to a
+// Handler when the run is using Config.Events or Config.StreamHandler.
+func sshCommandStream(ex *execution, conn *hostConnection, job *Job, jobIndex int) *Result {
 	streamResult := &Result{}
+	// published is set once streamResult has been written to resultChannel. After this point, the host's
+	// completion must be reported through DoneChannel, rather than writing the result a second time.
+	var published bool
+	// readers is done once all output has been sent to the streams. The session is closed first on early returns, so
+	// the readers reach EOF.
+	var readers sync.WaitGroup
+	var stdout, stderr *outputStream
+	// output is how long the Result's output is wanted for. It outlives the job, so that the worker can move on while
+	// it's still being read. It's abandoned if the host is cancelled while the job is running, or at any point if the
+	// Result or the run is cancelled. detached is set atomically once the job has finished.
+	output, abandonOutput := context.WithCancel(ex.ctx)
+	var detached int32
+	go func() {
+		select {
+		case <-conn.ctx.Done():
+			if atomic.LoadInt32(&detached) == 0 {
+				abandonOutput()
+			}
+		case <-output.Done():
+		}
+	}()
+	ex.handle.start()
 	// This is needed so we don't need to write to the channel before every return statement when erroring..
 	defer func() {
-		if streamResult.Error != nil {
-			resultChannel <- streamResult
-			NumberOfStreamingHostsCompleted++
+		readers.Wait()
+		atomic.StoreInt32(&detached, 1)
+		streamResult.IsSlow = atomic.LoadInt32(&streamResult.slow) == 1
+		ex.handle.finish(streamResult)
+		if ex.results == nil {
+			abandonOutput()
+			ex.reportCompleted(conn, streamResult)
+		} else if !published {
+			abandonOutput()
+			ex.publish(conn, streamResult)
 		} else {
-			streamResult.DoneChannel <- struct{}{}
+			ex.finishOutput(streamResult, stdout, stderr, abandonOutput)
 		}
+		ex.handle.wg.Done()
 	}()
 
 	// Never send to the result channel with a blank host.
-	streamResult.Host = host
+	streamResult.Host = conn.host
+	streamResult.JobIndex = jobIndex
+	streamResult.ExitCode = -1
+	streamResult.cancel = func() {
+		conn.cancel()
+		abandonOutput()
+	}
 
-	client, err := generateSSHClientWithPotentialBastion(host, config)
-	if err != nil {
-		streamResult.Error = err
-		return
+	// Only the host's first job connects, unless it's connection was dropped.
+	if conn.client == nil && conn.err == nil {
+		ex.emit(Event{Type: HostConnecting, Host: conn.host, JobIndex: jobIndex})
 	}
-	defer client.Close()
 
-	session, err := newClientSession(client)
+	session, err := conn.newSession(ex, streamResult)
 	if err != nil {
-		streamResult.Error = fmt.Errorf("failed to create session: %s", err)
-		return
+		streamResult.Error = err
+		return streamResult
 	}
 	defer session.Close()
 
 	// Get job string
-	streamResult.Job = getJob(session, config.Job)
+	streamResult.Job = getJob(session, job)
 
 	// Set the stdout pipe which we will read/redirect later to our stdout channel
 	StdOutPipe, err := session.StdoutPipe()
 	if err != nil {
-		streamResult.Error = fmt.Errorf("could not set StdOutPipe: %s", err)
-		return
+		streamResult.Error = newError(ErrSession, conn.host, fmt.Errorf("could not set StdOutPipe: %w", err))
+		return streamResult
 	}
-	// Channel used for streaming stdout
-	streamResult.StdOutStream = make(chan []byte)
 
 	// Set the stderr pipe which we will read/redirect later to our stderr channel
 	StdErrPipe, err := session.StderrPipe()
 	if err != nil {
-		streamResult.Error = fmt.Errorf("could not set StdOutPipe: %s", err)
-		return
+		streamResult.Error = newError(ErrSession, conn.host, fmt.Errorf("could not set StdErrPipe: %w", err))
+		return streamResult
 	}
-	// Channel used for streaming stderr
-	streamResult.StdErrStream = make(chan []byte)
 
-	// Set up a special channel to report completion of the ssh task. This is easier than handling exit codes etc.
-	//
-	// Using struct{} for memory saving as it takes up 0 bytes; bool take up 1, and we don't actually care
-	// what is written to the done channel, just that "something" is read from it so that we know the
-	// command exited.
-	streamResult.DoneChannel = make(chan struct{})
+	// Output is reported as events, or to the Handler, instead when using Config.Events or Config.StreamHandler, in
+	// which case the Result's channels aren't used. Output waits for the job's start to be reported first, as the
+	// readers start before the job does.
+	started := make(chan struct{})
+	var startOnce sync.Once
+	markStarted := func() { startOnce.Do(func() { close(started) }) }
+	defer markStarted()
+	sendStdout := func(line []byte) {
+		<-started
+		ex.report(conn, StdoutLine, streamResult, line)
+	}
+	sendStderr := func(line []byte) {
+		<-started
+		ex.report(conn, StderrLine, streamResult, line)
+	}
+	if ex.results != nil {
+		// Channels used for streaming stdout and stderr, which are buffered according to Config.StreamBufferSize.
+		stdout = newOutputStream(ex.config, output.Done(), &streamResult.dropped)
+		stderr = newOutputStream(ex.config, output.Done(), &streamResult.dropped)
+		streamResult.StdOutStream = stdout.ch
+		streamResult.StdErrStream = stderr.ch
+		sendStdout = stdout.send
+		sendStderr = stderr.send
+
+		// Set up a special channel to report completion of the ssh task. This is easier than handling exit codes etc.
+		//
+		// Using struct{} for memory saving as it takes up 0 bytes; bool take up 1, and we don't actually care
+		// what is written to the done channel, just that "something" is read from it so that we know the
+		// command exited.
+		streamResult.DoneChannel = make(chan struct{}, 1)
+	}
 
 	// Reading from our pipes as they're populated, and redirecting bytes to our stdout and stderr channels in Result.
 	//
 	// We're doing this before we start the ssh task so we can start churning through output as soon as it starts.
-	var wg sync.WaitGroup
-	wg.Add(2)
+	onSlow := func() {
+		ex.report(conn, HostSlow, streamResult, nil)
+		if ex.config.CancelSlowHosts {
+			conn.cancelSlow()
+		}
+	}
+	// Output on either stream counts as activity. The monitor is stopped before the host's completion is reported.
+	monitor := newActivityMonitor(ex.config.SlowTimeout, streamResult, onSlow, ex.config.SlowEvents)
+	defer monitor.stop()
+
+	// Each stream has it's own reader, so a job that writes a lot to stderr can't fill the session's window while
+	// stdout is being read, and block the command.
+	var stdoutErr, stderrErr error
+	readers.Add(2)
 	go func() {
-		readToBytesChannel(StdOutPipe, streamResult.StdOutStream, streamResult, config.SlowTimeout, &wg)
-		readToBytesChannel(StdErrPipe, streamResult.StdErrStream, streamResult, config.SlowTimeout, &wg)
+		defer readers.Done()
+		stdoutErr = readOutput(StdOutPipe, ex.config.Framing, ex.config.MaxChunkSize, sendStdout, monitor)
+		stdout.close()
+	}()
+	go func() {
+		defer readers.Done()
+		stderrErr = readOutput(StdErrPipe, ex.config.Framing, ex.config.MaxChunkSize, sendStderr, monitor)
+		stderr.close()
 	}()
 
-	resultChannel <- streamResult
+	if ex.results != nil {
+		if !ex.publish(conn, streamResult) {
+			streamResult.Error = ex.ctxErr(conn)
+			return streamResult
+		}
+		published = true
+	}
 
 	// Start the job immediately, but don't wait for the command to exit.
 	//
 	// Currently, will hang if a host fails to connect, in which case the SSHTimeout value is how long it takes for this func to return.
+	if err := requestPTY(ex.config, session); err != nil {
+		streamResult.Error = newError(ErrSession, conn.host, err)
+		return streamResult
+	}
+	watcher := conn.watchJob(ex, session)
 	if err := startJob(session, streamResult.Job); err != nil {
-		streamResult.Error = fmt.Errorf("could not start job: %s", err)
-		return
+		watcher.finish(conn, streamResult)
+		streamResult.Error = newError(ErrStart, conn.host, fmt.Errorf("could not start job: %w", err))
+		return streamResult
+	}
+	ex.report(conn, HostStarted, streamResult, nil)
+	markStarted()
+
+	// Wait for the command to exit only after we've read all of it's output.
+	readers.Wait()
+	err = session.Wait()
+	reason := watcher.finish(conn, streamResult)
+	monitor.stop()
+	streamResult.setExitStatus(err)
+
+	if jobErr := ex.jobError(conn, reason, err); jobErr != nil {
+		streamResult.Error = jobErr
+	} else if readErr := firstError(stdoutErr, stderrErr); readErr != nil {
+		streamResult.Error = newError(ErrRead, conn.host, fmt.Errorf("couldn't read content to stream channel: %w", readErr))
 	}
+	return streamResult
+}
 
-	// Check to see if we should close. Close the underlying network connection, not the session as it doesn't close the pipes correctly.
+// finishOutput writes to r's DoneChannel once everything sent to it's streams has been read, or the output has been
+// abandoned, without holding up the host. release is called once it has.
+func (ex *execution) finishOutput(r *Result, stdout *outputStream, stderr *outputStream, release context.CancelFunc) {
+	ex.outputs.Add(1)
 	go func() {
-		select {
-		case <-config.Stop:
-			client.Close()
+		defer ex.outputs.Done()
+		defer release()
+
+		if err := firstError(stdout.drain(), stderr.drain()); err != nil && r.Error == nil {
+			r.Error = newError(ErrRead, r.Host, fmt.Errorf("couldn't read content to stream channel: %w", err))
 		}
+		r.Dropped = int(atomic.LoadInt64(&r.dropped))
+		// DoneChannel has room for the value, so a Result that's been abandoned doesn't hold anything up.
+		r.DoneChannel <- struct{}{}
 	}()
+}
 
-	// Wait for the command to exit only after we've initiated all the output channels
-	wg.Wait()
-	session.Wait()
+// publish sends r to the run's Result channel, unless the host is cancelled before it's received, in which case it
+// returns false. A Result that's ready to be received is always sent, even if the host has been cancelled.
+func (ex *execution) publish(conn *hostConnection, r *Result) bool {
+	select {
+	case ex.results <- r:
+		return true
+	default:
+	}
+
+	select {
+	case ex.results <- r:
+		return true
+	case <-conn.ctx.Done():
+		return false
+	}
+}
+
+// firstError returns the first of errs that isn't nil.
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	NumberOfStreamingHostsCompleted++
+// queuedHost is a host waiting to be run by a worker.
+type queuedHost struct {
+	host     string
+	requeues int // Number of times the host has been re-queued after being cancelled for being slow.
 }
 
-// readToBytesChannel reads from io.Reader and directs the data to a byte slice channel for streaming.
-func readToBytesChannel(reader io.Reader, stream chan []byte, r *Result, slowTimeout int, wg *sync.WaitGroup) {
-	defer func() { wg.Done() }()
+// hostQueue feeds hosts to the worker pool. Hosts can be re-queued, so the queue is only closed once every host has
+// finished.
+type hostQueue struct {
+	hosts   chan queuedHost
+	pending sync.WaitGroup
+}
 
-	slowTimeoutDuration := time.Duration(slowTimeout) * time.Second
-	t := time.NewTimer(slowTimeoutDuration)
+func newHostQueue(hosts []string) *hostQueue {
+	q := &hostQueue{
+		// A host is never in the queue more than once, so there is always room to re-queue it.
+		hosts: make(chan queuedHost, len(hosts)),
+	}
+	q.pending.Add(len(hosts))
+	for _, host := range hosts {
+		q.hosts <- queuedHost{host: host}
+	}
 
 	go func() {
-		for {
-			select {
-			case <-t.C:
-				t.Stop()
-				r.IsSlow = true
-				break
-			}
-		}
+		q.pending.Wait()
+		close(q.hosts)
 	}()
+	return q
+}
 
-	rdr := bufio.NewReader(reader)
-	for {
-		line, err := rdr.ReadBytes('\n') // ReadBytes will wait until new line character is read.
-		t.Reset(slowTimeoutDuration)
-		if err != nil {
-			if err == io.EOF {
-				return
-			} else {
-				r.Error = fmt.Errorf("couldn't read content to stream channel: %s", err)
-				return
-			}
+// done records that a host has finished, and won't be re-queued.
+func (q *hostQueue) done() {
+	q.pending.Done()
+}
+
+// requeue adds h to the back of the queue to be run again.
+func (q *hostQueue) requeue(h queuedHost) {
+	h.requeues++
+	q.hosts <- h
+}
+
+// worker connects to each host in the queue, and runs every job on it using the same connection. Each job is run in
+// it's own session.
+func worker(ex *execution, queue *hostQueue, results chan<- Result) {
+	jobs := ex.jobs
+
+	for h := range queue.hosts {
+		// Hosts that are still queued when the run is aborted are skipped entirely.
+		if ex.isAborted() {
+			ex.skip(len(jobs))
+			queue.done()
+			continue
 		}
 
-		stream <- line
+		// Hold the handle open until we know whether the host will be re-queued.
+		ex.hold()
+		conn := newHostConnection(ex, h.host)
+		failed := runHost(ex, conn, results)
+		conn.close()
+
+		if conn.isSlowCancelled() && h.requeues < ex.config.SlowHostRequeues && !ex.isAborted() {
+			ex.addJobs(len(jobs))
+			queue.requeue(h)
+		} else {
+			if failed {
+				atomic.AddInt64(&ex.failedHosts, 1)
+			}
+			queue.done()
+		}
+		ex.release()
 	}
 }
 
-// worker invokes sshCommand for each host in the channel
-func worker(hosts <-chan string, results chan<- Result, config *Config, resChan chan *Result) {
-	// This check to determine Run vs. Stream is safe because massh.Config.Stream() will not allow work to be done if it's channel
-	// parameter is nil, so we only get a nil resChan when using massh.Config.Run().
-	//
-	// TODO: Make the handling of a JobStack more elegant.
-	if resChan == nil {
-		for host := range hosts {
-			if config.JobStack != nil {
-				for i := range *config.JobStack {
-					// Cfg is a copy of config, without job pointers. This is needed to separate the jobstack.
-					cfg := copyConfigNoJobs(config)
-
-					j := (*config.JobStack)[i]
-					cfg.Job = &j
-
-					results <- sshCommand(host, cfg)
-				}
-			} else {
-				results <- sshCommand(host, config)
-			}
+// runHost runs every job on the host in order, returning true if any of them failed.
+func runHost(ex *execution, conn *hostConnection, results chan<- Result) (failed bool) {
+	jobs := ex.jobs
+	for i, job := range jobs {
+		if ex.isAborted() {
+			ex.skip(len(jobs) - i)
+			return failed
 		}
-	} else {
-		for host := range hosts {
-			if config.JobStack != nil {
-				for i := range *config.JobStack {
-					// Cfg is a copy of config, without job pointers. This is needed to separate the jobstack.
-					cfg := copyConfigNoJobs(config)
-
-					j := (*config.JobStack)[i]
-					cfg.Job = &j
-
-					sshCommandStream(host, cfg, resChan)
-				}
-			} else {
-				sshCommandStream(host, config, resChan)
-			}
+
+		// Every streaming run has a handle, so we only get a nil handle when using massh.Config.Run().
+		var r *Result
+		if ex.handle == nil {
+			res := sshCommand(ex, conn, job, i)
+			r = &res
+			results <- res
+		} else {
+			r = sshCommandStream(ex, conn, job, i)
+		}
+		success := r.Success()
+
+		if ex.canaryPhase && !ex.config.Canary.passes(r) {
+			atomic.StoreInt32(&ex.canaryFailed, 1)
+		}
+
+		if success {
+			continue
+		}
+		failed = true
+		if ex.config.JobStackPolicy == ContinueOnFailure {
+			continue
 		}
+		if ex.config.JobStackPolicy == AbortRunOnFailure {
+			ex.abort(ErrRunAborted)
+		}
+		ex.skip(len(jobs) - i - 1)
+		return failed
 	}
+	return failed
 }
 
-func copyConfigNoJobs(config *Config) *Config {
-	return &Config{
-		Hosts:                config.Hosts,
-		SSHConfig:            config.SSHConfig,
-		BastionHost:          config.BastionHost,
-		BastionHostSSHConfig: config.BastionHostSSHConfig,
-		WorkerPool:           config.WorkerPool,
+// skip records that n host jobs will not be run.
+func (ex *execution) skip(n int) {
+	if ex.handle != nil && n > 0 {
+		ex.handle.skip(n)
 	}
 }
 
-// runStream is mostly the same as run, except it directs the results to a channel so they can be processed
-// before the command has completed executing (i.e streaming the stdout and stderr as it runs).
-func runStream(c *Config, rs chan *Result) {
-	// Channels length is always how many hosts we have multiplied by the number of jobs we're running.
-	var resultChanLength int
-	if c.JobStack != nil {
-		resultChanLength = len(c.Hosts) * len(*c.JobStack)
-	} else {
-		resultChanLength = len(c.Hosts)
-	}
-	hosts := make(chan string, len(c.Hosts))
-	results := make(chan Result, resultChanLength)
+// addJobs registers n more host jobs with the handle, which must be completed before it's Done.
+func (ex *execution) addJobs(n int) {
+	if ex.handle != nil {
+		ex.handle.add(n)
+	}
+}
+
+// hold registers a placeholder with the handle, so that it can't be Done until release is called.
+func (ex *execution) hold() {
+	ex.addJobs(1)
+}
 
-	// Set up a worker pool that will accept hosts on the hosts channel.
-	for i := 0; i < c.WorkerPool; i++ {
-		go worker(hosts, results, c, rs)
+// release completes a placeholder registered by hold.
+func (ex *execution) release() {
+	if ex.handle != nil {
+		ex.handle.wg.Done()
 	}
+}
 
+// runHosts runs every job on hosts using the worker pool, and returns once they have all finished.
+func (ex *execution) runHosts(hosts []string, results chan<- Result) {
 	// This is what actually triggers the worker(s). Each workers takes a host, and when it becomes
 	// available again, it will take another host as long as there are host to be received.
-	for k := range c.Hosts {
-		hosts <- k // send each host to the channel
+	queue := newHostQueue(hosts)
+
+	// Set up a worker pool that will accept hosts on the queue.
+	var wg sync.WaitGroup
+	wg.Add(ex.config.WorkerPool)
+	for i := 0; i < ex.config.WorkerPool; i++ {
+		go func() {
+			defer wg.Done()
+			worker(ex, queue, results)
+		}()
 	}
-	// Indicate nothing more will be written
-	close(hosts)
+
+	wg.Wait()
 }
 
-// run sets up goroutines, worker pool, and returns the command results for all hosts as a slice of Result. This can cause
-// excessive memory usage if returning a large amount of data for a large number of hosts.
-func run(c *Config) (res []Result) {
-	// Channels length is always how many hosts we have multiplied by the number of jobs we're running.
-	var resultChanLength int
-	if c.JobStack != nil {
-		resultChanLength = len(c.Hosts) * len(*c.JobStack)
-	} else {
-		resultChanLength = len(c.Hosts)
-	}
-	// Channels length is always how many hosts we have
-	hosts := make(chan string, len(c.Hosts))
-	results := make(chan Result, resultChanLength)
+// dispatch runs any canaries, followed by the remaining hosts one batch at a time. If the run is halted before every
+// host has run, the reason is returned.
+func (ex *execution) dispatch(results chan<- Result) error {
+	hosts := ex.config.sortedHosts()
+	canaries, remaining := ex.config.canaries(hosts)
+	jobs := len(ex.jobs)
+
+	if len(canaries) > 0 {
+		ex.canaryPhase = true
+		ex.runHosts(canaries, results)
+		ex.canaryPhase = false
+
+		// Canaries that were stopped will fail, but the run wasn't halted because of them.
+		if atomic.LoadInt32(&ex.canaryFailed) == 1 && !ex.isAborted() {
+			ex.halt(ErrCanaryFailed, len(remaining)*jobs)
+			return ErrCanaryFailed
+		}
+	}
+
+	batches := ex.config.batches(remaining)
+	for i, batch := range batches {
+		ex.runHosts(batch, results)
+
+		if ex.isAborted() || ex.config.Rolling == nil || i == len(batches)-1 {
+			continue
+		}
+		if ex.config.Rolling.thresholdExceeded(int(atomic.LoadInt64(&ex.failedHosts)), len(hosts)) {
+			var skipped int
+			for _, batch := range batches[i+1:] {
+				skipped += len(batch) * jobs
+			}
+			ex.halt(ErrFailureThresholdExceeded, skipped)
+			return ErrFailureThresholdExceeded
+		}
+	}
 
-	// Set up a worker pool that will accept hosts on the hosts channel.
-	for i := 0; i < c.WorkerPool; i++ {
-		go worker(hosts, results, c, nil)
+	// Any hosts left after the run was aborted have been skipped by the workers.
+	if ex.isAborted() {
+		return ex.abortErr
 	}
+	return nil
+}
 
-	for k := range c.Hosts {
-		hosts <- k // send each host to the channel
+// halt records that the run was stopped early because of err, and that n host jobs will not be run.
+func (ex *execution) halt(err error, n int) {
+	// The error must be set before the remaining host jobs are marked as complete, so it's available once the
+	// handle's Done channel is closed.
+	if ex.handle != nil {
+		ex.handle.setErr(err)
 	}
-	close(hosts)
+	ex.skip(n)
+}
+
+// runStream is mostly the same as run, except it directs the results to a channel so they can be processed
+// before the command has completed executing (i.e streaming the stdout and stderr as it runs).
+func runStream(ctx context.Context, c *Config, rs chan *Result) *StreamHandle {
+	ex := newStreamExecution(ctx, c)
+	ex.results = rs
+	ex.handle.closeWhenFinished(ex.finish)
+
+	go ex.dispatch(nil)
+
+	return ex.handle
+}
+
+// runEvents streams the run as events. The channel is closed after RunFinished has been sent.
+func runEvents(ctx context.Context, c *Config) <-chan Event {
+	events := make(chan Event)
+
+	ex := newStreamExecution(ctx, c)
+	ex.events = events
+	ex.handle.closeWhenFinished(ex.finish, func() {
+		// Every host has completed, so nothing else is sending.
+		events <- Event{Type: RunFinished, Time: time.Now(), Err: ex.handle.Err()}
+		close(events)
+	})
+
+	go ex.dispatch(nil)
+
+	return events
+}
+
+// runHandler streams the run to h.
+func runHandler(ctx context.Context, c *Config, h Handler) *StreamHandle {
+	ex := newStreamExecution(ctx, c)
+	ex.handler = h
+	ex.handle.closeWhenFinished(ex.finish)
+
+	go ex.dispatch(nil)
+
+	return ex.handle
+}
+
+// newStreamExecution is newExecution for a streaming run, whose progress is tracked by a StreamHandle. Bastion
+// connections are shared by every host, and closed once they've all finished.
+func newStreamExecution(ctx context.Context, c *Config) *execution {
+	ex := newExecution(ctx, c)
+	ex.handle = newStreamHandle()
+	ex.handle.add(len(c.Hosts) * len(ex.jobs))
+	return ex
+}
+
+// run sets up goroutines, worker pool, and returns the command results for all hosts as a slice of Result. This can cause
+// excessive memory usage if returning a large amount of data for a large number of hosts.
+//
+// If the run is halted early, the results of hosts that did run are returned alongside the error.
+func run(ctx context.Context, c *Config) ([]Result, error) {
+	// Bastion connections are shared by every host, and closed once they've all finished.
+	ex := newExecution(ctx, c)
+	defer ex.finish()
+
+	// Channels length is at most how many hosts we have multiplied by the number of jobs we're running. There may be
+	// fewer results if jobs are skipped by Config.JobStackPolicy or Config.Rolling.
+	resultChanLength := len(c.Hosts) * len(ex.jobs)
+	results := make(chan Result, resultChanLength)
+
+	var err error
+	go func() {
+		err = ex.dispatch(results)
+		// Close results once every host has finished, so we know there's nothing left to collect.
+		close(results)
+	}()
 
-	for r := 0; r < resultChanLength; r++ {
-		res = append(res, <-results)
+	var res []Result
+	for r := range results {
+		res = append(res, r)
 	}
 
-	return res
+	return res, err
 }
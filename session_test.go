@@ -1,10 +1,16 @@
 package massh
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -47,8 +53,6 @@ var (
 )
 
 func TestSshCommandStream(t *testing.T) {
-	NumberOfStreamingHostsCompleted = 0
-
 	if err := testConfig.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
 		t.Log(err)
 		t.FailNow()
@@ -57,7 +61,7 @@ func TestSshCommandStream(t *testing.T) {
 	resChan := make(chan *Result)
 
 	// This should be the last responsibility from the massh package. Handling the Result channel is up to the user.
-	err := testConfig.Stream(resChan)
+	handle, err := testConfig.Stream(resChan)
 	if err != nil {
 		t.Log(err)
 		t.FailNow()
@@ -79,14 +83,11 @@ func TestSshCommandStream(t *testing.T) {
 					readStream(result, &wg, t)
 				}
 			}()
-		default:
-			if NumberOfStreamingHostsCompleted == len(testConfig.Hosts) {
-				// We want to wait for all goroutines to complete before we declare that the work is finished, as
-				// it's possible for us to execute this code before the gofunc above has completed if left unchecked.
-				wg.Wait()
+		case <-handle.Done():
+			// The goroutines above may still be reading output, until each DoneChannel is written to.
+			wg.Wait()
 
-				return
-			}
+			return
 		}
 	}
 }
@@ -97,15 +98,13 @@ func TestSshCommandStreamWithSlowHost(t *testing.T) {
 	testConfig.Job = testJobSlow
 
 	// Specify our slow timeout (remove value at end of func.)
-	testConfig.SlowTimeout = 3
+	testConfig.SlowTimeout = 3 * time.Second
 
 	// Must revert when test concludes.
 	defer func() {
 		testConfig.Job = jobBackup
 	}()
 
-	NumberOfStreamingHostsCompleted = 0
-
 	if err := testConfig.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
 		t.Log(err)
 		t.FailNow()
@@ -114,7 +113,7 @@ func TestSshCommandStreamWithSlowHost(t *testing.T) {
 	resChan := make(chan *Result)
 
 	// This should be the last responsibility from the massh package. Handling the Result channel is up to the user.
-	err := testConfig.Stream(resChan)
+	handle, err := testConfig.Stream(resChan)
 	if err != nil {
 		t.Log(err)
 		t.FailNow()
@@ -136,14 +135,11 @@ func TestSshCommandStreamWithSlowHost(t *testing.T) {
 					readStreamSlow(result, &wg, t)
 				}
 			}()
-		default:
-			if NumberOfStreamingHostsCompleted == len(testConfig.Hosts) {
-				// We want to wait for all goroutines to complete before we declare that the work is finished, as
-				// it's possible for us to execute this code before the gofunc above has completed if left unchecked.
-				wg.Wait()
+		case <-handle.Done():
+			// The goroutines above may still be reading output, until each DoneChannel is written to.
+			wg.Wait()
 
-				return
-			}
+			return
 		}
 	}
 }
@@ -151,8 +147,6 @@ func TestSshCommandStreamWithSlowHost(t *testing.T) {
 // Test for bugs in lots of lines.
 func TestSshCommandStreamBigData(t *testing.T) {
 	defer func() { testConfig.Job = testJob }()
-	NumberOfStreamingHostsCompleted = 0
-
 	if err := testConfig.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
 		t.Log(err)
 		t.FailNow()
@@ -165,7 +159,7 @@ func TestSshCommandStreamBigData(t *testing.T) {
 	resChan := make(chan *Result)
 
 	// This should be the last responsibility from the massh package. Handling the Result channel is up to the user.
-	err := testConfig.Stream(resChan)
+	handle, err := testConfig.Stream(resChan)
 	if err != nil {
 		t.Log(err)
 		t.FailNow()
@@ -187,14 +181,11 @@ func TestSshCommandStreamBigData(t *testing.T) {
 					readStream(result, &wg, t)
 				}
 			}()
-		default:
-			if NumberOfStreamingHostsCompleted == len(testConfig.Hosts) {
-				// We want to wait for all goroutines to complete before we declare that the work is finished, as
-				// it's possible for us to execute this code before the gofunc above has completed if left unchecked.
-				wg.Wait()
+		case <-handle.Done():
+			// The goroutines above may still be reading output, until each DoneChannel is written to.
+			wg.Wait()
 
-				return
-			}
+			return
 		}
 	}
 }
@@ -338,15 +329,13 @@ func TestSshCommandStreamWithJobStack(t *testing.T) {
 	resChan := make(chan *Result)
 
 	// This should be the last responsibility from the massh package. Handling the Result channel is up to the user.
-	NumberOfStreamingHostsCompleted = 0
-	err := testConfig.Stream(resChan)
+	handle, err := testConfig.Stream(resChan)
 	if err != nil {
 		t.Log(err)
 		t.FailNow()
 	}
 
 	var wg sync.WaitGroup
-	numberOfExpectedCompletions := len(testConfig.Hosts) * len(*testConfig.JobStack)
 	// This can probably be cleaner. We're hindered somewhat, I think, by reading a channel from a channel.
 	for {
 		select {
@@ -362,32 +351,409 @@ func TestSshCommandStreamWithJobStack(t *testing.T) {
 					readStream(result, &wg, t)
 				}
 			}()
-		default:
-			if NumberOfStreamingHostsCompleted == numberOfExpectedCompletions {
-				// We want to wait for all goroutines to complete before we declare that the work is finished, as
-				// it's possible for us to execute this code before the gofunc above has completed if left unchecked.
-				wg.Wait()
-				return
+		case <-handle.Done():
+			// The goroutines above may still be reading output, until each DoneChannel is written to.
+			wg.Wait()
+
+			expected := len(testConfig.Hosts) * len(*testConfig.JobStack)
+			if handle.Started() != expected || handle.Succeeded() != expected || handle.Failed() != 0 {
+				t.Logf("Unexpected counters, expected %d started and succeeded: started %d, succeeded %d, failed %d",
+					expected, handle.Started(), handle.Succeeded(), handle.Failed())
+				t.Fail()
 			}
+			return
 		}
 	}
 }
 
 func TestSSHCommandStreamStop(t *testing.T) {
-	NumberOfStreamingHostsCompleted = 0
+	// A single worker, so the second host is still queued when the first is stopped.
+	cfg := &Config{
+		Hosts:     map[string]struct{}{"localhost": {}, "127.0.0.1": {}},
+		SSHConfig: testSSHConfig,
+		// We want a continuous job here, but something that sleeps to ensure we're able to close things correctly.
+		// Experienced some weird behaviour where only high output commands were closing when terminating the session.
+		Job: &Job{
+			Command: "while sleep 2; do hexdump -Cn16 /dev/urandom; done",
+		},
+		WorkerPool: 1,
+	}
 
-	jobBackup := testConfig.Job
+	if err := cfg.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
 
-	defer func() {
-		testConfig.Job = jobBackup
-	}()
+	resChan := make(chan *Result)
+
+	handle, err := cfg.Stream(resChan)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	time.AfterFunc(3*time.Second, cfg.StopAllSessions)
+
+	var results int
+	for {
+		select {
+		case result := <-resChan:
+			results++
+		read:
+			for {
+				select {
+				case d := <-result.StdOutStream:
+					fmt.Print(string(d))
+				case <-result.DoneChannel:
+					break read
+				}
+			}
+
+			if !errors.Is(result.Error, ErrCancelled) || !errors.Is(result.Error, ErrStopped) {
+				t.Logf("Expected host %s to be stopped, got: %v", result.Host, result.Error)
+				t.Fail()
+			}
+		case <-handle.Done():
+			if results != 1 || handle.Skipped() != 1 {
+				t.Logf("Expected one host to be stopped and the queued host to be skipped, got %d results and %d skipped", results, handle.Skipped())
+				t.Fail()
+			}
+			if !errors.Is(handle.Err(), ErrStopped) {
+				t.Logf("Expected the stream to be halted with ErrStopped, got: %v", handle.Err())
+				t.Fail()
+			}
+			return
+		case <-time.After(15 * time.Second):
+			t.Log("Stream didn't finish after StopAllSessions")
+			t.FailNow()
+		}
+	}
+}
+
+func TestSshStopAllSessionsRun(t *testing.T) {
+	// A single worker, so the second host is still queued when the first is stopped.
+	cfg := &Config{
+		Hosts:     map[string]struct{}{"localhost": {}, "127.0.0.1": {}},
+		SSHConfig: testSSHConfig,
+		Job: &Job{
+			Command: "sleep 10",
+		},
+		WorkerPool: 1,
+	}
+
+	if err := cfg.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// The deprecated channel should still stop a run.
+	cfg.Stop = make(chan struct{}, 1)
+	time.AfterFunc(time.Second, func() { cfg.Stop <- struct{}{} })
+
+	start := time.Now()
+	res, err := cfg.Run()
+	if !errors.Is(err, ErrStopped) {
+		t.Errorf("Expected the run to return ErrStopped, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected run to be stopped, but it took %s", elapsed)
+	}
+	// Only the running host returns a Result, as the queued host is skipped.
+	if len(res) != 1 {
+		t.Fatalf("Expected a single result from the stopped host, got %d", len(res))
+	}
+	if !errors.Is(res[0].Error, ErrCancelled) || !errors.Is(res[0].Error, ErrStopped) {
+		t.Errorf("Expected host %s to be stopped, got: %v", res[0].Host, res[0].Error)
+	}
+
+	// A stop before the run starts has no effect.
+	cfg.Hosts = testHosts
+	cfg.Stop = nil
+	cfg.StopAllSessions()
+	cfg.Job = &Job{Command: "true"}
+	res, err = cfg.Run()
+	if err != nil || len(res) != 1 || !res[0].Success() {
+		t.Errorf("Expected a later run to succeed, got %v (error: %v)", res, err)
+	}
+}
+
+func TestSshCommandStreamStderr(t *testing.T) {
+	// Enough stderr to fill the session's window before anything is written to stdout.
+	cfg := &Config{
+		Hosts:     testHosts,
+		SSHConfig: testSSHConfig,
+		Job: &Job{
+			Command: "for i in $(seq 1 300000); do echo \"error $i\" >&2; done; echo \"Hello, World\"",
+		},
+		WorkerPool: 10,
+	}
+
+	if err := cfg.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	resChan := make(chan *Result)
+	if _, err := cfg.Stream(resChan); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	result := <-resChan
+	var stdout, stderr int
+	timeout := time.After(20 * time.Second)
+read:
+	for {
+		select {
+		case <-result.StdOutStream:
+			stdout++
+		case <-result.StdErrStream:
+			stderr++
+		case <-result.DoneChannel:
+			break read
+		case <-timeout:
+			t.Log("Stream blocked reading stderr")
+			t.FailNow()
+		}
+	}
+
+	// Every line has been received by the time DoneChannel is written to.
+	if stdout != 1 || stderr != 300000 || !result.Success() {
+		t.Errorf("Expected 1 stdout and 300000 stderr lines, got %d and %d (error: %v)", stdout, stderr, result.Error)
+	}
+}
+
+func TestSshEvents(t *testing.T) {
+	cfg := &Config{
+		// Nothing listens on port 1, so the second host fails to connect.
+		Hosts:     map[string]struct{}{"localhost": {}, "localhost:1": {}},
+		SSHConfig: testSSHConfig,
+		Job: &Job{
+			Command: "echo \"Hello, World\"; echo \"Goodbye\" >&2",
+		},
+		WorkerPool: 10,
+	}
+
+	if err := cfg.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	events, err := cfg.Events()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	got := map[string][]EventType{}
+	var finished bool
+	timeout := time.After(20 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				if !finished {
+					t.Error("Channel was closed without sending RunFinished")
+				}
+				if want := []EventType{HostConnecting, HostStarted, StdoutLine, StderrLine, HostExited}; !sameEvents(got["localhost"], want) {
+					t.Errorf("Expected events %v for localhost, got %v", want, got["localhost"])
+				}
+				if want := []EventType{HostConnecting, HostFailed}; !reflect.DeepEqual(got["localhost:1"], want) {
+					t.Errorf("Expected events %v for localhost:1, got %v", want, got["localhost:1"])
+				}
+				return
+			}
+			if finished {
+				t.Errorf("Unexpected %s event after RunFinished", e.Type)
+			}
+			if e.Time.IsZero() {
+				t.Errorf("Expected %s event to have a time", e.Type)
+			}
+
+			switch e.Type {
+			case RunFinished:
+				finished = true
+				if e.Err != nil {
+					t.Errorf("Unexpected error for RunFinished: %v", e.Err)
+				}
+				continue
+			case StdoutLine:
+				if string(e.Data) != "Hello, World\n" {
+					t.Errorf("Unexpected stdout line: %q", e.Data)
+				}
+			case HostExited:
+				if e.Result == nil || !e.Result.Success() {
+					t.Errorf("Expected a successful Result for %s", e.Host)
+				}
+			case HostFailed:
+				if !errors.Is(e.Err, ErrDial) {
+					t.Errorf("Expected dial error for %s, got: %v", e.Host, e.Err)
+				}
+			}
+			got[e.Host] = append(got[e.Host], e.Type)
+		case <-timeout:
+			t.Log("Events channel wasn't closed")
+			t.FailNow()
+		}
+	}
+}
+
+// sameEvents reports whether got matches want, allowing stdout and stderr lines to arrive in either order.
+func sameEvents(got, want []EventType) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] && !(isOutput(got[i]) && isOutput(want[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+func isOutput(t EventType) bool {
+	return t == StdoutLine || t == StderrLine
+}
+
+// recordingHandler records the calls made for each host, and whether any of them were concurrent.
+type recordingHandler struct {
+	mu         sync.Mutex
+	calls      map[string][]string
+	running    map[string]bool
+	concurrent bool
+}
+
+func (h *recordingHandler) record(host, call string) {
+	h.mu.Lock()
+	if h.running[host] {
+		h.concurrent = true
+	}
+	h.running[host] = true
+	h.calls[host] = append(h.calls[host], call)
+	h.mu.Unlock()
+
+	// Give any concurrent call for the same host a chance to overlap.
+	time.Sleep(time.Millisecond)
+
+	h.mu.Lock()
+	h.running[host] = false
+	h.mu.Unlock()
+}
+
+func (h *recordingHandler) OnStart(r *Result)               { h.record(r.Host, "start") }
+func (h *recordingHandler) OnStdout(r *Result, line []byte) { h.record(r.Host, "stdout") }
+func (h *recordingHandler) OnStderr(r *Result, line []byte) { h.record(r.Host, "stderr") }
+func (h *recordingHandler) OnExit(r *Result)                { h.record(r.Host, "exit") }
+func (h *recordingHandler) OnError(r *Result, err error)    { h.record(r.Host, "error") }
+
+func TestSshStreamHandler(t *testing.T) {
+	cfg := &Config{
+		// Nothing listens on port 1, so the last host fails to connect.
+		Hosts:     map[string]struct{}{"localhost": {}, "127.0.0.1": {}, "localhost:1": {}},
+		SSHConfig: testSSHConfig,
+		Job: &Job{
+			Command: "for i in $(seq 1 20); do echo \"out $i\"; echo \"err $i\" >&2; done",
+		},
+		WorkerPool: 10,
+	}
 
-	testConfig.Stop = make(chan struct{})
+	if err := cfg.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	h := &recordingHandler{calls: map[string][]string{}, running: map[string]bool{}}
+	handle, err := cfg.StreamHandler(h)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	select {
+	case <-handle.Done():
+	case <-time.After(20 * time.Second):
+		t.Log("Stream didn't finish")
+		t.FailNow()
+	}
+
+	if h.concurrent {
+		t.Error("Handler was called concurrently for the same host")
+	}
+	for _, host := range []string{"localhost", "127.0.0.1"} {
+		calls := h.calls[host]
+		if len(calls) != 42 || calls[0] != "start" || calls[41] != "exit" {
+			t.Errorf("Expected start, 40 lines of output and exit for %s, got: %v", host, calls)
+		}
+	}
+	if calls := h.calls["localhost:1"]; !reflect.DeepEqual(calls, []string{"error"}) {
+		t.Errorf("Expected only an error for localhost:1, got: %v", calls)
+	}
+}
+
+func TestSshCommandStreamOverflow(t *testing.T) {
+	for _, overflow := range []OverflowPolicy{OverflowDropOldest, OverflowSpill} {
+		cfg := &Config{
+			Hosts:     testHosts,
+			SSHConfig: testSSHConfig,
+			Job: &Job{
+				Command: "seq 1 1000",
+			},
+			WorkerPool: 10,
+		}
+		cfg.SetStreamBuffer(10, overflow)
+
+		if err := cfg.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		resChan := make(chan *Result)
+		if _, err := cfg.Stream(resChan); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		result := <-resChan
+
+		// A slow consumer shouldn't hold up the job, which has finished by the time we start reading.
+		time.Sleep(time.Second)
+
+		var lines []string
+	read:
+		for {
+			select {
+			case d := <-result.StdOutStream:
+				lines = append(lines, strings.TrimSpace(string(d)))
+			case <-result.StdErrStream:
+			case <-result.DoneChannel:
+				break read
+			case <-time.After(10 * time.Second):
+				t.Logf("%s: stream didn't finish", overflow)
+				t.FailNow()
+			}
+		}
+
+		if !result.Success() {
+			t.Errorf("%s: unexpected error: %v", overflow, result.Error)
+		}
+		switch overflow {
+		case OverflowDropOldest:
+			if result.Dropped == 0 || len(lines)+result.Dropped != 1000 || lines[len(lines)-1] != "1000" {
+				t.Errorf("Expected the newest lines to be kept, got %d lines and %d dropped", len(lines), result.Dropped)
+			}
+		case OverflowSpill:
+			if len(lines) != 1000 || lines[0] != "1" || lines[999] != "1000" || result.Dropped != 0 {
+				t.Errorf("Expected every line to be received in order, got %d lines and %d dropped", len(lines), result.Dropped)
+			}
+		}
+	}
+}
+
+func TestSshRunContextCancel(t *testing.T) {
+	jobBackup := testConfig.Job
+	defer func() { testConfig.Job = jobBackup }()
 
-	// We want a continuous job here, but something that sleeps to ensure we're able to close things correctly.
-	// Experienced some weird behaviour where only high output commands were closing when terminating the session.
 	testConfig.Job = &Job{
-		Command: "while sleep 2; do hexdump -Cn16 /dev/urandom; done",
+		Command: "sleep 10",
 	}
 
 	if err := testConfig.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
@@ -395,50 +761,882 @@ func TestSSHCommandStreamStop(t *testing.T) {
 		t.FailNow()
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	res, err := testConfig.RunContext(ctx)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Logf("Expected run to be cancelled, but it took %s", elapsed)
+		t.Fail()
+	}
+
+	for i := range res {
+		if !errors.Is(res[i].Error, context.DeadlineExceeded) || !errors.Is(res[i].Error, ErrTimeout) {
+			t.Logf("Expected deadline exceeded for host %s, got: %v", res[i].Host, res[i].Error)
+			t.Fail()
+		}
+	}
+}
+
+func TestSshCommandStreamResultCancel(t *testing.T) {
+	// Use a separate config, so we don't share a stop channel with previous tests.
+	cfg := &Config{
+		Hosts:     testHosts,
+		SSHConfig: testSSHConfig,
+		Job: &Job{
+			Command: "while sleep 1; do echo running; done",
+		},
+		WorkerPool: 10,
+	}
+
+	if err := cfg.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
 	resChan := make(chan *Result)
 
-	// This should be the last responsibility from the massh package. Handling the Result channel is up to the user.
-	err := testConfig.Stream(resChan)
+	_, err := cfg.StreamContext(context.Background(), resChan)
 	if err != nil {
 		t.Log(err)
 		t.FailNow()
 	}
 
-	// Close the session after 3 seconds. I think it's fine to just sleep here.
-	go func() {
-		var count int
+	for i := 0; i < len(cfg.Hosts); i++ {
+		result := <-resChan
+		if result.Error != nil {
+			t.Logf("Unexpected error in stream test for host %s: %s", result.Host, result.Error)
+			t.FailNow()
+		}
+
+		time.AfterFunc(2*time.Second, result.Cancel)
+
+	read:
 		for {
-			time.Sleep(3 * time.Second)
+			select {
+			case d := <-result.StdOutStream:
+				fmt.Print(string(d))
+			case <-result.DoneChannel:
+				break read
+			}
+		}
 
-			t.Logf("Sending stop %d", count)
-			testConfig.Stop <- struct{}{}
+		if !errors.Is(result.Error, context.Canceled) || !errors.Is(result.Error, ErrCancelled) {
+			t.Logf("Expected cancelled error for host %s, got: %v", result.Host, result.Error)
+			t.Fail()
 		}
-	}()
+	}
+}
 
-	var wg sync.WaitGroup
-	// This can probably be cleaner. We're hindered somewhat, I think, by reading a channel from a channel.
-	for {
-		select {
-		case result := <-resChan:
-			wg.Add(1)
-			go func() {
-				if result.Error != nil {
-					t.Logf("Unexpected error in stream test for host %s: %s", result.Host, result.Error)
-					t.Fail()
+func TestSshCommandStreamAbandoned(t *testing.T) {
+	cfg := &Config{
+		Hosts:     testHosts,
+		SSHConfig: testSSHConfig,
+		Job: &Job{
+			Command: "while true; do echo running; sleep 0.1; done",
+		},
+		WorkerPool: 10,
+	}
 
-					wg.Done()
-				} else {
-					readStream(result, &wg, t)
-				}
-			}()
-		default:
-			if NumberOfStreamingHostsCompleted == len(testConfig.Hosts) {
-				// We want to wait for all goroutines to complete before we declare that the work is finished, as
-				// it's possible for us to execute this code before the gofunc above has completed if left unchecked.
-				wg.Wait()
+	if err := cfg.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
 
-				return
+	// Neither the output nor DoneChannel are ever read, but cancelling the host should still finish the run.
+	resChan := make(chan *Result)
+	handle, err := cfg.Stream(resChan)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	result := <-resChan
+	time.AfterFunc(time.Second, result.Cancel)
+
+	select {
+	case <-handle.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Stream didn't finish after an abandoned host was cancelled")
+	}
+
+	// The same goes for cancelling the run when nothing is reading the Result channel at all.
+	ctx, cancel := context.WithCancel(context.Background())
+	handle, err = cfg.StreamContext(ctx, make(chan *Result))
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	time.AfterFunc(time.Second, cancel)
+
+	select {
+	case <-handle.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Stream didn't finish after a run with no consumer was cancelled")
+	}
+}
+
+func TestSshCommandStreamUnread(t *testing.T) {
+	for _, overflow := range []OverflowPolicy{OverflowDropOldest, OverflowSpill} {
+		// A single worker, so the second host only starts once the first has been finished with.
+		cfg := &Config{
+			Hosts:     map[string]struct{}{"localhost": {}, "127.0.0.1": {}},
+			SSHConfig: testSSHConfig,
+			Job: &Job{
+				Command: "seq 1 100",
+			},
+			WorkerPool: 1,
+		}
+		cfg.SetStreamBuffer(10, overflow)
+
+		if err := cfg.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		resChan := make(chan *Result)
+		handle, err := cfg.Stream(resChan)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		// Results are received, but their output isn't read until every host has completed.
+		var results []*Result
+	receive:
+		for {
+			select {
+			case result := <-resChan:
+				results = append(results, result)
+			case <-handle.Done():
+				break receive
+			case <-time.After(10 * time.Second):
+				t.Fatalf("%s: stream didn't finish while output was unread, got %d results", overflow, len(results))
+			}
+		}
+		if len(results) != 2 {
+			t.Fatalf("%s: expected 2 results, got %d", overflow, len(results))
+		}
+
+		// The output is still there to be read, and DoneChannel follows it.
+		for _, result := range results {
+			var lines int
+		read:
+			for {
+				select {
+				case <-result.StdOutStream:
+					lines++
+				case <-result.DoneChannel:
+					break read
+				case <-time.After(5 * time.Second):
+					t.Fatalf("%s: output wasn't delivered after the run finished", overflow)
+				}
+			}
+			if overflow == OverflowSpill && lines != 100 {
+				t.Errorf("%s: expected 100 lines from %s, got %d", overflow, result.Host, lines)
+			}
+			if overflow == OverflowDropOldest && lines+result.Dropped != 100 {
+				t.Errorf("%s: expected 100 lines from %s, got %d and %d dropped", overflow, result.Host, lines, result.Dropped)
 			}
 		}
 	}
 }
+
+func TestSshBulkExitStatus(t *testing.T) {
+	jobBackup := testConfig.Job
+	defer func() { testConfig.Job = jobBackup }()
+
+	testConfig.Job = &Job{
+		Command: "echo \"Hello, World\"; exit 3",
+	}
+
+	if err := testConfig.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	res, err := testConfig.Run()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	for i := range res {
+		if res[i].Success() {
+			t.Logf("Expected host %s to be unsuccessful", res[i].Host)
+			t.Fail()
+		}
+		if res[i].ExitCode != 3 {
+			t.Logf("Expected exit code 3 from host %s, got %d (error: %v)", res[i].Host, res[i].ExitCode, res[i].Error)
+			t.Fail()
+		}
+		var exitErr *ssh.ExitError
+		if !errors.Is(res[i].Error, ErrRemoteExit) || !errors.As(res[i].Error, &exitErr) {
+			t.Logf("Expected ErrRemoteExit caused by *ssh.ExitError from host %s, got %v", res[i].Host, res[i].Error)
+			t.Fail()
+		}
+		if !strings.Contains(string(res[i].Output), "Hello, World") {
+			t.Logf("Expected output to be kept for host %s, got: %s", res[i].Host, res[i].Output)
+			t.Fail()
+		}
+	}
+}
+
+func TestSshBulkStderr(t *testing.T) {
+	jobBackup := testConfig.Job
+	defer func() {
+		testConfig.Job = jobBackup
+		testConfig.InterleaveOutput = false
+	}()
+
+	testConfig.Job = &Job{
+		Command: "echo out; echo err 1>&2; printf partial",
+	}
+	testConfig.EnableInterleavedOutput()
+
+	if err := testConfig.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	res, err := testConfig.Run()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	for i := range res {
+		if string(res[i].Output) != "out\npartial" {
+			t.Logf("Unexpected stdout from host %s: %q", res[i].Host, res[i].Output)
+			t.Fail()
+		}
+		if string(res[i].Stderr) != "err\n" {
+			t.Logf("Unexpected stderr from host %s: %q", res[i].Host, res[i].Stderr)
+			t.Fail()
+		}
+
+		var stdoutLines, stderrLines int
+		for _, l := range res[i].Interleaved {
+			switch l.Stream {
+			case Stdout:
+				stdoutLines++
+			case Stderr:
+				stderrLines++
+			}
+		}
+		if stdoutLines != 2 || stderrLines != 1 {
+			t.Logf("Unexpected interleaved output from host %s: %d stdout and %d stderr lines", res[i].Host, stdoutLines, stderrLines)
+			t.Fail()
+		}
+	}
+}
+
+func TestSshUnknownHostKey(t *testing.T) {
+	cb, err := KnownHostsCallback(writeKnownHosts(t, "# empty"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshConfig := *testSSHConfig
+	sshConfig.HostKeyCallback = cb
+
+	cfg := &Config{
+		Hosts:      testHosts,
+		SSHConfig:  &sshConfig,
+		Job:        testJob,
+		WorkerPool: 10,
+	}
+
+	res, err := cfg.Run()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	for i := range res {
+		var hkErr *HostKeyError
+		if !errors.Is(res[i].Error, ErrHostKey) || !errors.As(res[i].Error, &hkErr) || !hkErr.Unknown() {
+			t.Logf("Expected unknown host key error for host %s, got: %v", res[i].Host, res[i].Error)
+			t.Fail()
+		}
+	}
+}
+
+func TestSshJumpHosts(t *testing.T) {
+	defer func() { testConfig.JumpHosts = nil }()
+
+	// Two hops, both through localhost.
+	testConfig.SetJumpHosts(JumpHost{Host: testBastionHost}, JumpHost{Host: testBastionHost})
+
+	if err := testConfig.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Logf("Couldn't set private key auth: %s", err)
+		t.FailNow()
+	}
+
+	res, err := testConfig.Run()
+	if err != nil {
+		t.Logf("Run failed to execute: %s", err)
+		t.FailNow()
+	}
+
+	for i := range res {
+		if res[i].Error != nil {
+			t.Logf("Unexpected error in jump host test for host %s: %s", res[i].Host, res[i].Error)
+			t.Fail()
+		}
+		if !strings.Contains(string(res[i].Output), "Hello, World") {
+			t.Logf("Expected output from jump host test not received from host %s: \n \t Output: %s \n \t Error: %s\n", res[i].Host, res[i].Output, res[i].Error)
+			t.Fail()
+		}
+	}
+}
+
+func TestSshBastionPool(t *testing.T) {
+	if err := testConfig.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Logf("Couldn't set private key auth: %s", err)
+		t.FailNow()
+	}
+
+	cfg := &Config{
+		SSHConfig:   testSSHConfig,
+		BastionHost: testBastionHost,
+	}
+
+	bastions := newBastionPool(1)
+	for i := 0; i < 3; i++ {
+		client, err := generateSSHClientWithPotentialBastion(context.Background(), "localhost", cfg, bastions)
+		if err != nil {
+			t.Logf("Unexpected error connecting through bastion: %s", err)
+			t.FailNow()
+		}
+		defer client.Close()
+	}
+
+	if len(bastions.chains) != 1 {
+		t.Fatalf("Expected 1 bastion chain, got %d", len(bastions.chains))
+	}
+	for _, slots := range bastions.chains {
+		if len(slots) != 1 || len(slots[0].clients) != 1 {
+			t.Errorf("Expected a single shared bastion connection")
+		}
+	}
+
+	bastions.close()
+
+	if _, err := generateSSHClientWithPotentialBastion(context.Background(), "localhost", cfg, bastions); !errors.Is(err, errBastionPoolClosed) || !errors.Is(err, ErrBastion) {
+		t.Errorf("Expected closed pool error, got: %v", err)
+	}
+}
+
+func TestSshJobStackPolicy(t *testing.T) {
+	if err := testConfig.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Logf("Couldn't set private key auth: %s", err)
+		t.FailNow()
+	}
+
+	failJob := Job{
+		Command: "exit 1",
+	}
+
+	cfg := &Config{
+		Hosts:          testHosts,
+		SSHConfig:      testSSHConfig,
+		JobStack:       &[]Job{*testJob, failJob, *testJob3},
+		JobStackPolicy: StopHostOnFailure,
+		WorkerPool:     10,
+	}
+
+	res, err := cfg.Run()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// The third job should be skipped on every host.
+	if len(res) != 2*len(cfg.Hosts) {
+		t.Fatalf("Expected %d results, got %d", 2*len(cfg.Hosts), len(res))
+	}
+	for i := range res {
+		if res[i].JobIndex == 2 {
+			t.Errorf("Expected job 2 to be skipped on host %s", res[i].Host)
+		}
+		if res[i].JobIndex == 1 && res[i].Success() {
+			t.Errorf("Expected job 1 to fail on host %s", res[i].Host)
+		}
+	}
+
+	// Both hosts point at the same server, but only the first should run before the run is aborted.
+	cfg.Hosts = map[string]struct{}{"localhost": {}, "127.0.0.1": {}}
+	cfg.JobStack = &[]Job{failJob, *testJob2}
+	cfg.JobStackPolicy = AbortRunOnFailure
+	cfg.WorkerPool = 1
+
+	res, err = cfg.Run()
+	if !errors.Is(err, ErrRunAborted) {
+		t.Errorf("Expected the run to return ErrRunAborted, got: %v", err)
+	}
+	if len(res) != 1 || res[0].JobIndex != 0 || res[0].ExitCode != 1 {
+		t.Errorf("Expected a single failed result, got: %+v", res)
+	}
+
+	// Streaming runs report the abort through StreamHandle.Err(), which is also RunFinished's error.
+	events, err := cfg.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last Event
+	for e := range events {
+		last = e
+	}
+	if last.Type != RunFinished || !errors.Is(last.Err, ErrRunAborted) {
+		t.Errorf("Expected the streaming run to finish with ErrRunAborted, got %s: %v", last.Type, last.Err)
+	}
+}
+
+func TestSshRolling(t *testing.T) {
+	if err := testConfig.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Logf("Couldn't set private key auth: %s", err)
+		t.FailNow()
+	}
+
+	// Both hosts point at the same server, but the second batch should never run.
+	cfg := &Config{
+		Hosts:      map[string]struct{}{"localhost": {}, "127.0.0.1": {}},
+		SSHConfig:  testSSHConfig,
+		Job:        &Job{Command: "exit 1"},
+		WorkerPool: 10,
+	}
+	cfg.SetRolling(RollingConfig{BatchSize: 1})
+
+	res, err := cfg.Run()
+	if err != ErrFailureThresholdExceeded {
+		t.Errorf("Expected ErrFailureThresholdExceeded, got: %v", err)
+	}
+	// Hosts are sorted, so the first batch is always 127.0.0.1.
+	if len(res) != 1 || res[0].Host != "127.0.0.1" {
+		t.Fatalf("Expected a single result from the first batch, got: %+v", res)
+	}
+
+	resChan := make(chan *Result)
+	handle, err := cfg.Stream(resChan)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	for {
+		select {
+		case r := <-resChan:
+			if r.DoneChannel == nil {
+				continue
+			}
+			go func() {
+				for {
+					select {
+					case <-r.StdOutStream:
+					case <-r.StdErrStream:
+					case <-r.DoneChannel:
+						return
+					}
+				}
+			}()
+		case <-handle.Done():
+			if handle.Err() != ErrFailureThresholdExceeded {
+				t.Errorf("Expected ErrFailureThresholdExceeded, got: %v", handle.Err())
+			}
+			if handle.Completed() != 1 || handle.Skipped() != 1 {
+				t.Errorf("Expected 1 completed and 1 skipped, got %d and %d", handle.Completed(), handle.Skipped())
+			}
+			return
+		}
+	}
+}
+
+func TestSshCanary(t *testing.T) {
+	if err := testConfig.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Logf("Couldn't set private key auth: %s", err)
+		t.FailNow()
+	}
+
+	// Both hosts point at the same server, so "localhost" is only a canary in name.
+	cfg := &Config{
+		Hosts:      map[string]struct{}{"localhost": {}, "127.0.0.1": {}},
+		SSHConfig:  testSSHConfig,
+		Job:        &Job{Command: "echo \"Hello, World\"; exit 1"},
+		WorkerPool: 10,
+	}
+	cfg.SetCanary(CanaryConfig{Hosts: []string{"localhost"}})
+
+	res, err := cfg.Run()
+	if err != ErrCanaryFailed {
+		t.Errorf("Expected ErrCanaryFailed, got: %v", err)
+	}
+	if len(res) != 1 || res[0].Host != "localhost" {
+		t.Fatalf("Expected a single result from the canary, got: %+v", res)
+	}
+
+	// A predicate that only checks the output should let the rest of the hosts run.
+	cfg.Canary.Check = func(r *Result) bool {
+		return strings.Contains(string(r.Output), "Hello, World")
+	}
+
+	res, err = cfg.Run()
+	if err != nil {
+		t.Errorf("Expected canary to pass, got: %v", err)
+	}
+	if len(res) != 2 || res[0].Host != "localhost" {
+		t.Errorf("Expected the canary followed by the remaining host, got: %+v", res)
+	}
+}
+
+func TestSshRetry(t *testing.T) {
+	if err := testConfig.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Logf("Couldn't set private key auth: %s", err)
+		t.FailNow()
+	}
+
+	// Nothing is listening on port 1, so every attempt should fail.
+	cfg := &Config{
+		Hosts:      map[string]struct{}{"localhost:1": {}},
+		SSHConfig:  testSSHConfig,
+		JobStack:   &[]Job{*testJob, *testJob2},
+		WorkerPool: 1,
+	}
+	cfg.SetRetryPolicy(RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 10 * time.Millisecond,
+	})
+
+	res, err := cfg.Run()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if len(res) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(res))
+	}
+	if !errors.Is(res[0].Error, ErrDial) || res[0].Attempts != 3 {
+		t.Errorf("Expected first job to fail after 3 attempts, got %d attempts (error: %v)", res[0].Attempts, res[0].Error)
+	}
+	if res[1].Error == nil || res[1].Attempts != 0 {
+		t.Errorf("Expected second job to fail without another attempt, got %d attempts (error: %v)", res[1].Attempts, res[1].Error)
+	}
+
+	// A classifier that refuses every error should stop after the first attempt.
+	cfg.JobStack = nil
+	cfg.Job = testJob
+	cfg.Retry.Retryable = func(err error) bool { return false }
+
+	res, _ = cfg.Run()
+	if len(res) != 1 || res[0].Attempts != 1 {
+		t.Errorf("Expected a single attempt, got: %+v", res)
+	}
+
+	// Successful hosts only need one attempt.
+	cfg.Hosts = testHosts
+	res, _ = cfg.Run()
+	if len(res) != 1 || !res[0].Success() || res[0].Attempts != 1 {
+		t.Errorf("Expected a successful single attempt, got: %+v", res)
+	}
+}
+
+func TestSshRetryBastion(t *testing.T) {
+	if err := testConfig.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Logf("Couldn't set private key auth: %s", err)
+		t.FailNow()
+	}
+
+	// The bastion drops the first connection, and forwards later ones to the real server.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var dials int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if atomic.AddInt32(&dials, 1) == 1 {
+				conn.Close()
+				continue
+			}
+			go func() {
+				defer conn.Close()
+				server, err := net.Dial("tcp", "localhost:22")
+				if err != nil {
+					return
+				}
+				defer server.Close()
+				go io.Copy(server, conn)
+				io.Copy(conn, server)
+			}()
+		}
+	}()
+
+	cfg := &Config{
+		Hosts:       testHosts,
+		SSHConfig:   testSSHConfig,
+		Job:         testJob,
+		WorkerPool:  1,
+		BastionHost: l.Addr().String(),
+	}
+	cfg.SetRetryPolicy(RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: 100 * time.Millisecond,
+	})
+
+	// The retry should connect to the bastion again, rather than being handed the first failure.
+	res, err := cfg.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || !res[0].Success() || res[0].Attempts != 2 {
+		t.Errorf("Expected the host to succeed on it's second attempt, got: %+v", res)
+	}
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Errorf("Expected 2 connections to the bastion, got %d", n)
+	}
+}
+
+func TestSshCommandStreamCancelSlowHosts(t *testing.T) {
+	if err := testConfig.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Logf("Couldn't set private key auth: %s", err)
+		t.FailNow()
+	}
+
+	cfg := &Config{
+		Hosts:       testHosts,
+		SSHConfig:   testSSHConfig,
+		Job:         testJobSlow,
+		WorkerPool:  10,
+		SlowTimeout: time.Second,
+	}
+	cfg.AutoCancelSlowHosts()
+	cfg.SetSlowHostRequeues(1)
+
+	resChan := make(chan *Result)
+	start := time.Now()
+	handle, err := cfg.Stream(resChan)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	var results []*Result
+	for {
+		select {
+		case r := <-resChan:
+			results = append(results, r)
+			if r.DoneChannel == nil {
+				continue
+			}
+			go func() {
+				for {
+					select {
+					case <-r.StdOutStream:
+					case <-r.StdErrStream:
+					case <-r.DoneChannel:
+						return
+					}
+				}
+			}()
+		case <-handle.Done():
+			// The host is run twice, and cancelled each time, well before the job would finish.
+			if time.Since(start) > 4*time.Second {
+				t.Errorf("Expected slow hosts to be cancelled, took %s", time.Since(start))
+			}
+			if len(results) != 2*len(cfg.Hosts) || handle.Completed() != len(results) {
+				t.Fatalf("Expected each host to be run twice, got %d results and %d completed", len(results), handle.Completed())
+			}
+			for _, r := range results {
+				if !errors.Is(r.Error, ErrCancelled) || !errors.Is(r.Error, ErrSlowHost) || !r.IsSlow {
+					t.Errorf("Expected slow host %s to be cancelled, got: %v", r.Host, r.Error)
+				}
+			}
+			return
+		}
+	}
+}
+
+func TestSshTimeouts(t *testing.T) {
+	if err := testConfig.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Logf("Couldn't set private key auth: %s", err)
+		t.FailNow()
+	}
+
+	sleepJob := Job{
+		Command: "sleep 10",
+	}
+
+	cfg := &Config{
+		Hosts:      testHosts,
+		SSHConfig:  testSSHConfig,
+		JobStack:   &[]Job{sleepJob, *testJob},
+		WorkerPool: 10,
+	}
+	cfg.SetJobTimeout(time.Second)
+	cfg.SetStopSignal(ssh.SIGTERM, 2*time.Second)
+
+	// The first job should be terminated by the signal, and the second should still run.
+	start := time.Now()
+	res, err := cfg.Run()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Expected job timeout to be enforced, took %s", time.Since(start))
+	}
+	if len(res) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(res))
+	}
+	if !errors.Is(res[0].Error, ErrTimeout) || res[0].ExitSignal != "TERM" || res[0].StopAction != StopSignalled {
+		t.Errorf("Expected first job to time out after SIGTERM, got signal %q and action %s (error: %v)", res[0].ExitSignal, res[0].StopAction, res[0].Error)
+	}
+	if !res[1].Success() {
+		t.Errorf("Expected second job to succeed, got: %v", res[1].Error)
+	}
+
+	// Without a signal, the connection is closed, and the second job has to reconnect.
+	cfg.SetStopSignal("", 0)
+	res, _ = cfg.Run()
+	if len(res) != 2 || !errors.Is(res[0].Error, ErrTimeout) || res[0].StopAction != StopClosed || !res[1].Success() {
+		t.Errorf("Expected the first job to time out, and the second to succeed, got: %+v", res)
+	}
+
+	// The host timeout covers every job on the host.
+	cfg.JobTimeout = 0
+	cfg.SetHostTimeout(time.Second)
+	res, _ = cfg.Run()
+	if len(res) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(res))
+	}
+	for i := range res {
+		if !errors.Is(res[i].Error, ErrTimeout) || !errors.Is(res[i].Error, context.DeadlineExceeded) {
+			t.Errorf("Expected job %d to time out, got: %v", res[i].JobIndex, res[i].Error)
+		}
+	}
+}
+
+func TestSshJobStackConnectionReuse(t *testing.T) {
+	if err := testConfig.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Logf("Couldn't set private key auth: %s", err)
+		t.FailNow()
+	}
+
+	// Every handshake checks the host key, so counting the checks counts the connections to each host.
+	var mu sync.Mutex
+	handshakes := make(map[string]int)
+	sshConfig := *testSSHConfig
+	sshConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		mu.Lock()
+		handshakes[hostname]++
+		mu.Unlock()
+		return testSSHConfig.HostKeyCallback(hostname, remote, key)
+	}
+
+	cfg := &Config{
+		Hosts:      testHosts,
+		SSHConfig:  &sshConfig,
+		JobStack:   &[]Job{*testJob, *testJob2, *testJob3},
+		WorkerPool: 10,
+	}
+
+	res, err := cfg.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3*len(testHosts) {
+		t.Fatalf("Expected %d results, got %d", 3*len(testHosts), len(res))
+	}
+	for i := range res {
+		if !res[i].Success() {
+			t.Errorf("Expected job %d on %s to succeed, got: %v", res[i].JobIndex, res[i].Host, res[i].Error)
+		}
+	}
+	if len(handshakes) != len(testHosts) {
+		t.Errorf("Expected a handshake with each of %d hosts, got: %v", len(testHosts), handshakes)
+	}
+	for host, n := range handshakes {
+		if n != 1 {
+			t.Errorf("Expected a single handshake with %s for the whole job stack, got %d", host, n)
+		}
+	}
+
+	// Closing the connection to stop a job means the next job has to reconnect.
+	handshakes = make(map[string]int)
+	cfg.JobStack = &[]Job{{Command: "sleep 10"}, *testJob, *testJob2}
+	cfg.SetJobTimeout(time.Second)
+	res, _ = cfg.Run()
+	if len(res) != 3*len(testHosts) {
+		t.Fatalf("Expected %d results, got %d", 3*len(testHosts), len(res))
+	}
+	for i := range res {
+		if res[i].JobIndex == 0 {
+			if res[i].StopAction != StopClosed {
+				t.Errorf("Expected the first job on %s to be stopped by closing the connection, got %s", res[i].Host, res[i].StopAction)
+			}
+		} else if !res[i].Success() {
+			t.Errorf("Expected job %d on %s to succeed, got: %v", res[i].JobIndex, res[i].Host, res[i].Error)
+		}
+	}
+	for host, n := range handshakes {
+		if n != 2 {
+			t.Errorf("Expected %s to be reconnected to once after the connection was closed, got %d handshakes", host, n)
+		}
+	}
+	if len(handshakes) != len(testHosts) {
+		t.Errorf("Expected handshakes with each of %d hosts, got: %v", len(testHosts), handshakes)
+	}
+}
+
+func TestSshRunContextStopSignal(t *testing.T) {
+	if err := testConfig.SetPrivateKeyAuth("~/.ssh/id_rsa", ""); err != nil {
+		t.Logf("Couldn't set private key auth: %s", err)
+		t.FailNow()
+	}
+
+	cfg := &Config{
+		Hosts:     testHosts,
+		SSHConfig: testSSHConfig,
+		Job: &Job{
+			Command: "trap 'echo \"Goodbye\"; exit 0' INT; while true; do sleep 0.1; done",
+		},
+		WorkerPool: 10,
+	}
+	cfg.SetStopSignal(ssh.SIGINT, 2*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Second, cancel)
+
+	res, err := cfg.RunContext(ctx)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	for i := range res {
+		if !errors.Is(res[i].Error, ErrCancelled) || res[i].StopAction != StopSignalled {
+			t.Errorf("Expected host %s to be cancelled with a signal, got action %s (error: %v)", res[i].Host, res[i].StopAction, res[i].Error)
+		}
+		if !strings.Contains(string(res[i].Output), "Goodbye") {
+			t.Errorf("Expected host %s to handle the signal, got: %s", res[i].Host, res[i].Output)
+		}
+	}
+
+	// Jobs should still run normally with a pseudo-terminal.
+	cfg.Job = testJob
+	cfg.EnablePTY()
+	res, _ = cfg.Run()
+	if len(res) != 1 || !res[0].Success() || res[0].StopAction != StopNone {
+		t.Errorf("Expected job with a pty to succeed, got: %+v", res)
+	}
+}
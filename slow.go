@@ -0,0 +1,127 @@
+package massh
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SlowEvent reports that a host has gone quiet for longer than Config.SlowTimeout, or has produced output again after
+// being slow.
+type SlowEvent struct {
+	Host     string
+	Job      string
+	JobIndex int
+	Slow     bool // True when the host has gone quiet, and false when it has recovered.
+	Time     time.Time
+}
+
+// activityMonitor flags a job as slow when neither stdout or stderr have produced any output for the slow timeout.
+type activityMonitor struct {
+	timeout time.Duration
+	r       *Result
+	onSlow  func()
+	events  chan<- SlowEvent
+
+	activity chan struct{}
+	done     chan struct{}
+	exited   chan struct{}
+}
+
+// newActivityMonitor starts monitoring r's job. If onSlow isn't nil, it's called the first time the job is slow.
+// Events are sent to events, if it isn't nil. The monitor must be stopped once the job has completed.
+//
+// A nil monitor is returned if timeout is zero, in which case slow detection is disabled.
+func newActivityMonitor(timeout time.Duration, r *Result, onSlow func(), events chan<- SlowEvent) *activityMonitor {
+	if timeout <= 0 {
+		return nil
+	}
+
+	m := &activityMonitor{
+		timeout:  timeout,
+		r:        r,
+		onSlow:   onSlow,
+		events:   events,
+		activity: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		exited:   make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+func (m *activityMonitor) run() {
+	defer close(m.exited)
+
+	t := time.NewTimer(m.timeout)
+	defer t.Stop()
+
+	var slow bool
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-m.activity:
+			if slow {
+				slow = false
+				m.emit(false)
+			}
+			if !t.Stop() {
+				select {
+				case <-t.C:
+				default:
+				}
+			}
+			t.Reset(m.timeout)
+		case <-t.C:
+			// The timer isn't reset until there's more activity.
+			slow = true
+			if atomic.CompareAndSwapInt32(&m.r.slow, 0, 1) && m.onSlow != nil {
+				m.onSlow()
+			}
+			m.emit(true)
+		}
+	}
+}
+
+// emit sends a SlowEvent, unless the job completes first.
+func (m *activityMonitor) emit(slow bool) {
+	if m.events == nil {
+		return
+	}
+
+	e := SlowEvent{
+		Host:     m.r.Host,
+		Job:      m.r.Job,
+		JobIndex: m.r.JobIndex,
+		Slow:     slow,
+		Time:     time.Now(),
+	}
+	select {
+	case m.events <- e:
+	case <-m.done:
+	}
+}
+
+// active records that the job has produced output. It never blocks.
+func (m *activityMonitor) active() {
+	if m == nil {
+		return
+	}
+	select {
+	case m.activity <- struct{}{}:
+	default:
+	}
+}
+
+// stop ends monitoring, and waits for the monitor to exit. It's safe to call stop more than once.
+func (m *activityMonitor) stop() {
+	if m == nil {
+		return
+	}
+	select {
+	case <-m.done:
+	default:
+		close(m.done)
+	}
+	<-m.exited
+}
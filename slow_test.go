@@ -0,0 +1,48 @@
+package massh
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestActivityMonitor(t *testing.T) {
+	r := &Result{Host: "host", Job: "job"}
+	events := make(chan SlowEvent)
+	var slowCalls int32
+
+	m := newActivityMonitor(50*time.Millisecond, r, func() { atomic.AddInt32(&slowCalls, 1) }, events)
+
+	// Activity should keep the host from being slow.
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		m.active()
+	}
+	if atomic.LoadInt32(&r.slow) == 1 {
+		t.Fatalf("Expected host with regular output not to be slow")
+	}
+
+	for _, want := range []bool{true, false, true} {
+		select {
+		case e := <-events:
+			if e.Slow != want || e.Host != "host" || e.Job != "job" {
+				t.Fatalf("Expected slow event %t for host, got: %+v", want, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for slow event %t", want)
+		}
+		if want {
+			m.active()
+		}
+	}
+
+	m.stop()
+	m.stop()
+	if atomic.LoadInt32(&r.slow) != 1 || atomic.LoadInt32(&slowCalls) != 1 {
+		t.Errorf("Expected host to be slow, with onSlow called once, got %d calls", slowCalls)
+	}
+
+	if newActivityMonitor(0, r, nil, nil) != nil {
+		t.Errorf("Expected slow detection to be disabled without a timeout")
+	}
+}
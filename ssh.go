@@ -5,47 +5,126 @@ The functions here are mostly abstractions to make things easier to adapt to new
 */
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 	"net"
 	"os"
+	"strings"
 )
 
 const (
 	sshAuthSockEnv = "SSH_AUTH_SOCK"
 )
 
-// dial is ssh.Dial
-func dial(network, host, port string, config *ssh.ClientConfig) (*ssh.Client, error) {
-	c, err := ssh.Dial(network, host+":"+port, config)
+// dial is ssh.Dial, except that ctx is honoured while connecting and during the handshake.
+func dial(ctx context.Context, network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	d := net.Dialer{Timeout: config.Timeout}
+	conn, err := d.DialContext(ctx, network, addr)
 	if err != nil {
-		return nil, err
+		if ctx.Err() != nil {
+			return nil, contextError(addr, ctx.Err())
+		}
+		return nil, newError(ErrDial, addr, err)
 	}
-	return c, nil
+	return newClientConn(ctx, conn, addr, config)
 }
 
-func dialViaBastionClient(network string, bastionHost string, remoteHost string, port string, config *ssh.ClientConfig) (*ssh.Client, error) {
-	bastionClient, err := ssh.Dial(network, bastionHost+":"+port, config)
-	if err != nil {
-		return nil, fmt.Errorf("unable to connect to bastion: %s", err)
+// newClientConn is ssh.NewClientConn, closing conn if ctx is done before the handshake completes.
+//
+// Errors from the HostKeyCallback are wrapped, rather than flattened into a string as ssh.NewClientConn does, so that
+// a *HostKeyError can be found with errors.As. Returned errors are always an *Error.
+func newClientConn(ctx context.Context, conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var hostKeyErr error
+	if callback := config.HostKeyCallback; callback != nil {
+		c := *config
+		c.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = callback(hostname, remote, key)
+			return hostKeyErr
+		}
+		config = &c
 	}
 
-	remoteHostConn, err := bastionClient.Dial(network, remoteHost+":"+port)
+	handshakeDone := make(chan struct{})
+	defer close(handshakeDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshakeDone:
+		}
+	}()
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
 	if err != nil {
-		return nil, fmt.Errorf("unable to connect to remote host: %s", err)
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, contextError(addr, ctx.Err())
+		}
+		if hostKeyErr != nil {
+			return nil, newError(ErrHostKey, addr, fmt.Errorf("ssh: handshake failed: %w", hostKeyErr))
+		}
+		// The ssh package doesn't export an error type for authentication failures.
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, newError(ErrAuth, addr, err)
+		}
+		return nil, newError(ErrDial, addr, err)
 	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
 
-	ncc, chans, reqs, err := ssh.NewClientConn(remoteHostConn, remoteHost+":"+port, config)
+// dialViaBastions connects to target through the chain of jump hosts. The connection to the jump hosts is taken from
+// bastions, and shared with every other host in the run.
+func dialViaBastions(ctx context.Context, network string, jumps []*hostTarget, target *hostTarget, bastions *bastionPool) (*ssh.Client, error) {
+	slot, bastionClient, err := bastions.get(ctx, network, jumps)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create remote host ssh client through bastion: %s", err)
+		return nil, bastionError(jumps[0].addr, err)
 	}
 
-	clientThroughBastion := ssh.NewClient(ncc, chans, reqs)
+	remoteHostConn, err := bastionClient.Dial(network, target.addr)
+	if _, ok := err.(*ssh.OpenChannelError); ok {
+		// The bastion is fine, but couldn't reach the remote host.
+		return nil, newError(ErrDial, target.addr, fmt.Errorf("unable to connect to remote host: %w", err))
+	} else if err != nil {
+		// The shared bastion connection may have dropped since we last used it, so try a fresh one before giving up.
+		slot.discard(bastionClient)
+		if slot, bastionClient, err = bastions.get(ctx, network, jumps); err != nil {
+			return nil, bastionError(jumps[0].addr, err)
+		}
+		if remoteHostConn, err = bastionClient.Dial(network, target.addr); err != nil {
+			return nil, newError(ErrDial, target.addr, fmt.Errorf("unable to connect to remote host: %w", err))
+		}
+	}
+
+	clientThroughBastion, err := newClientConn(ctx, remoteHostConn, target.addr, target.sshConfig)
+	if err != nil {
+		e := err.(*Error)
+		e.Err = fmt.Errorf("unable to create remote host ssh client through bastion: %w", e.Err)
+		return nil, e
+	}
 
 	return clientThroughBastion, nil
 }
 
+// bastionError returns err as an ErrBastion, unless it already is one.
+func bastionError(addr string, err error) error {
+	if errors.Is(err, ErrBastion) {
+		return err
+	}
+	return newError(ErrBastion, addr, err)
+}
+
+// dialViaClient creates a new ssh.Client for addr, tunnelled through client.
+func dialViaClient(ctx context.Context, network string, client *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := client.Dial(network, addr)
+	if err != nil {
+		return nil, newError(ErrDial, addr, err)
+	}
+	return newClientConn(ctx, conn, addr, config)
+}
+
 // newClientSession is ssh.Client.NewSession
 func newClientSession(client *ssh.Client) (*ssh.Session, error) {
 	session, err := client.NewSession()
@@ -55,23 +134,30 @@ func newClientSession(client *ssh.Client) (*ssh.Session, error) {
 	return session, nil
 }
 
-func generateSSHClientWithPotentialBastion(host string, config *Config) (*ssh.Client, error) {
-	if config.BastionHost != "" {
-		var sshConf *ssh.ClientConfig
-		if config.BastionHostSSHConfig != nil {
-			sshConf = config.BastionHostSSHConfig
-		} else {
-			sshConf = config.SSHConfig
-		}
+func generateSSHClientWithPotentialBastion(ctx context.Context, host string, config *Config, bastions *bastionPool) (*ssh.Client, error) {
+	target, err := resolveHost(host, config)
+	if err != nil {
+		return nil, newError(ErrDial, host, err)
+	}
 
-		client, err := dialViaBastionClient("tcp", config.BastionHost, host, sshPort, sshConf)
+	// Jump hosts in the Config take precedence over a ProxyJump from the ssh config file.
+	jumps, err := resolveJumpHosts(config)
+	if err != nil {
+		return nil, newError(ErrBastion, config.BastionHost, err)
+	}
+	if jumps == nil {
+		jumps = target.jumps
+	}
+
+	if len(jumps) > 0 {
+		client, err := dialViaBastions(ctx, "tcp", jumps, target, bastions)
 		if err != nil {
 			return nil, err
 		}
 		return client, nil
 	}
 
-	client, err := dial("tcp", host, sshPort, config.SSHConfig)
+	client, err := dial(ctx, "tcp", target.addr, target.sshConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -107,5 +193,19 @@ func sshAuthSock() (ssh.AuthMethod, error) {
 	if err != nil {
 		return nil, err
 	}
-	return ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers), nil
+	return newPublicKeyAuth(agent.NewClient(sshAgent).Signers), nil
+}
+
+// publicKeyAuth is a publickey ssh.AuthMethod added by massh. It keeps it's source of signers, so they can be combined
+// with identity files from an ssh config file, as only one publickey method is ever attempted per connection.
+type publicKeyAuth struct {
+	ssh.AuthMethod
+	signers func() ([]ssh.Signer, error)
+}
+
+func newPublicKeyAuth(signers func() ([]ssh.Signer, error)) *publicKeyAuth {
+	return &publicKeyAuth{
+		AuthMethod: ssh.PublicKeysCallback(signers),
+		signers:    signers,
+	}
 }
@@ -0,0 +1,332 @@
+package massh
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// sshConfigFile is a parsed OpenSSH client config file, such as ~/.ssh/config.
+//
+// Only the Host keyword, and the HostName, User, Port, IdentityFile and ProxyJump options are used. Options inside
+// Match blocks are ignored, as are Include directives.
+type sshConfigFile struct {
+	blocks []sshConfigBlock
+
+	// Signers are cached by file, so that each identity file is only read once per config.
+	mu      sync.Mutex
+	signers map[string]ssh.Signer
+}
+
+// sshConfigBlock is a Host block, and the options that follow it.
+type sshConfigBlock struct {
+	patterns []string
+	options  [][2]string // Keyword (lower case) and value pairs, in the order they appear.
+}
+
+// sshConfigEntry is the result of looking up a host alias in an sshConfigFile. Empty values were not set.
+type sshConfigEntry struct {
+	alias         string
+	HostName      string
+	User          string
+	Port          string
+	IdentityFiles []string
+	ProxyJump     string
+}
+
+// LoadSSHConfigFile reads an OpenSSH client config file, typically ~/.ssh/config. Each host in Hosts, and any
+// ProxyJump host, will be resolved using the file's HostName, User, Port, IdentityFile and ProxyJump options before
+// connecting.
+//
+// Values set with SetHostConfig take precedence over the file, as does a port included in the host's entry in Hosts.
+// A ProxyJump is only used when BastionHost isn't set.
+//
+// IdentityFile keys are tried alongside keys added with SetPrivateKeyAuth or SetSSHAuthSock. If the SSH config's Auth
+// has an ssh.PublicKeys or ssh.PublicKeysCallback method added directly, IdentityFile is ignored instead, as only one
+// publickey method is attempted per connection, and those keys would never be tried otherwise.
+func (c *Config) LoadSSHConfigFile(path string) error {
+	path = expandHome(path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to read ssh config file: %s", err)
+	}
+	defer f.Close()
+
+	scf, err := parseSSHConfig(f)
+	if err != nil {
+		return fmt.Errorf("unable to parse ssh config file %s: %s", filepath.Base(path), err)
+	}
+	c.sshConfigFile = scf
+
+	return nil
+}
+
+func parseSSHConfig(r io.Reader) (*sshConfigFile, error) {
+	// Options before the first Host keyword apply to every host.
+	f := &sshConfigFile{
+		blocks:  []sshConfigBlock{{patterns: []string{"*"}}},
+		signers: map[string]ssh.Signer{},
+	}
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Keywords are separated from their arguments by whitespace, and optionally one "=".
+		i := strings.IndexAny(line, " \t=")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: missing argument for %s", lineNo, line)
+		}
+		keyword := strings.ToLower(line[:i])
+		value := strings.TrimSpace(line[i:])
+		value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+
+		args, err := splitSSHConfigArgs(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNo, err)
+		}
+		if len(args) == 0 {
+			return nil, fmt.Errorf("line %d: missing argument for %s", lineNo, keyword)
+		}
+
+		switch keyword {
+		case "host":
+			f.blocks = append(f.blocks, sshConfigBlock{patterns: args})
+		case "match":
+			// Match criteria aren't supported, so nothing in this block will ever apply.
+			f.blocks = append(f.blocks, sshConfigBlock{})
+		default:
+			b := &f.blocks[len(f.blocks)-1]
+			b.options = append(b.options, [2]string{keyword, args[0]})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// splitSSHConfigArgs splits a value on whitespace, keeping double quoted arguments together.
+func splitSSHConfigArgs(value string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	var inQuotes, inArg bool
+
+	for _, r := range value {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			inArg = true
+		case (r == ' ' || r == '\t') && !inQuotes:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// lookup returns the options that apply to alias. As with OpenSSH, the first value obtained for each option is
+// used, except for IdentityFile, which accumulates.
+func (f *sshConfigFile) lookup(alias string) *sshConfigEntry {
+	e := &sshConfigEntry{alias: alias}
+	for _, b := range f.blocks {
+		if !matchSSHConfigPatterns(b.patterns, alias) {
+			continue
+		}
+		for _, o := range b.options {
+			switch o[0] {
+			case "hostname":
+				if e.HostName == "" {
+					e.HostName = strings.ReplaceAll(o[1], "%h", alias)
+				}
+			case "user":
+				if e.User == "" {
+					e.User = o[1]
+				}
+			case "port":
+				if e.Port == "" {
+					e.Port = o[1]
+				}
+			case "identityfile":
+				e.IdentityFiles = append(e.IdentityFiles, o[1])
+			case "proxyjump":
+				if e.ProxyJump == "" {
+					e.ProxyJump = o[1]
+				}
+			}
+		}
+	}
+	return e
+}
+
+// matchSSHConfigPatterns reports whether host matches a Host line's patterns. A matching negated pattern excludes
+// the host, regardless of any other pattern.
+func matchSSHConfigPatterns(patterns []string, host string) bool {
+	var matched bool
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "!") {
+			if matchSSHConfigPattern(p[1:], host) {
+				return false
+			}
+			continue
+		}
+		if matchSSHConfigPattern(p, host) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchSSHConfigPattern matches host against a pattern containing the wildcards "*" and "?".
+func matchSSHConfigPattern(pattern, host string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(host); i >= 0; i-- {
+				if matchSSHConfigPattern(pattern[1:], host[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(host) == 0 {
+				return false
+			}
+		default:
+			if len(host) == 0 || !strings.EqualFold(pattern[:1], host[:1]) {
+				return false
+			}
+		}
+		pattern, host = pattern[1:], host[1:]
+	}
+	return len(host) == 0
+}
+
+// apply updates addr, port and c with the entry's options. Ports that are already set are kept, and User and Auth
+// are only changed if setUser and setAuth are true respectively.
+func (e *sshConfigEntry) apply(f *sshConfigFile, addr *string, port *string, c *ssh.ClientConfig, setUser bool, setAuth bool) error {
+	if e.HostName != "" {
+		*addr = e.HostName
+	}
+	if *port == "" {
+		*port = e.Port
+	}
+	if setUser && e.User != "" {
+		c.User = e.User
+	}
+	if setAuth && len(e.IdentityFiles) > 0 {
+		signers, err := f.identitySigners(e.IdentityFiles, e.alias, c.User)
+		if err != nil {
+			return err
+		}
+		if len(signers) > 0 {
+			c.Auth = withIdentities(c.Auth, signers)
+		}
+	}
+	return nil
+}
+
+// publicKeysType is the type of method returned by ssh.PublicKeys and ssh.PublicKeysCallback.
+var publicKeysType = reflect.TypeOf(ssh.PublicKeys())
+
+// withIdentities returns auth with the identity file signers added. Only the first publickey method is ever
+// attempted, so the identities are combined with any keys added by SetPrivateKeyAuth or SetSSHAuthSock into a single
+// method, which is tried first. Identity files come before the other keys, as they're specific to the host.
+//
+// Publickey methods that weren't added by massh can't be combined, so if auth has one, it's returned unchanged, and
+// the identities aren't used.
+func withIdentities(auth []ssh.AuthMethod, identities []ssh.Signer) []ssh.AuthMethod {
+	for _, a := range auth {
+		if reflect.TypeOf(a) == publicKeysType {
+			return auth
+		}
+	}
+
+	sources := []func() ([]ssh.Signer, error){
+		func() ([]ssh.Signer, error) { return identities, nil },
+	}
+	var rest []ssh.AuthMethod
+	for _, a := range auth {
+		if pk, ok := a.(*publicKeyAuth); ok {
+			sources = append(sources, pk.signers)
+			continue
+		}
+		rest = append(rest, a)
+	}
+
+	combined := newPublicKeyAuth(func() ([]ssh.Signer, error) {
+		var signers []ssh.Signer
+		for _, source := range sources {
+			// An unavailable agent shouldn't prevent the other keys from being tried.
+			s, err := source()
+			if err != nil {
+				continue
+			}
+			signers = append(signers, s...)
+		}
+		return signers, nil
+	})
+	return append([]ssh.AuthMethod{combined}, rest...)
+}
+
+// identitySigners reads the identity files, skipping those that don't exist or require a passphrase.
+func (f *sshConfigFile) identitySigners(files []string, alias string, user string) ([]ssh.Signer, error) {
+	home, _ := homedir.Dir()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var signers []ssh.Signer
+	for _, file := range files {
+		file = expandHome(file)
+		file = strings.NewReplacer("%d", home, "%h", alias, "%r", user, "%%", "%").Replace(file)
+
+		if s, ok := f.signers[file]; ok {
+			signers = append(signers, s)
+			continue
+		}
+
+		key, err := ioutil.ReadFile(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("unable to read identity file: %s", err)
+		}
+		s, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			if _, ok := err.(*ssh.PassphraseMissingError); ok {
+				continue
+			}
+			return nil, fmt.Errorf("unable to parse identity file %s: %s", filepath.Base(file), err)
+		}
+		f.signers[file] = s
+		signers = append(signers, s)
+	}
+	return signers, nil
+}
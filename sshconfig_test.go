@@ -0,0 +1,129 @@
+package massh
+
+import (
+	"golang.org/x/crypto/ssh"
+	"strings"
+	"testing"
+)
+
+var testSSHConfigFile = `
+# Applies to every host, but only where nothing earlier has set a value.
+User defaultUser
+
+Host web-*.example.com !web-9.example.com
+    Port 2222
+    ProxyJump jumpUser@bastion:2200,db1
+
+Host bastion
+    HostName bastion.example.com
+
+Host db1 db2
+    HostName %h.internal
+    User=dbUser
+    IdentityFile "~/.ssh/does not exist"
+
+Match user root
+    Port 9999
+
+Host *
+    Port 22
+    User ignoredUser
+`
+
+func TestSSHConfigLookup(t *testing.T) {
+	f, err := parseSSHConfig(strings.NewReader(testSSHConfigFile))
+	if err != nil {
+		t.Fatalf("Unexpected parse error: %s", err)
+	}
+
+	tests := []struct {
+		alias     string
+		hostName  string
+		user      string
+		port      string
+		proxyJump string
+		identity  int
+	}{
+		{"web-1.example.com", "", "defaultUser", "2222", "jumpUser@bastion:2200,db1", 0},
+		{"web-9.example.com", "", "defaultUser", "22", "", 0},
+		{"db2", "db2.internal", "defaultUser", "22", "", 1},
+		{"other", "", "defaultUser", "22", "", 0},
+	}
+
+	for _, tt := range tests {
+		e := f.lookup(tt.alias)
+		if e.HostName != tt.hostName || e.User != tt.user || e.Port != tt.port || e.ProxyJump != tt.proxyJump || len(e.IdentityFiles) != tt.identity {
+			t.Errorf("Unexpected entry for %s: %+v", tt.alias, e)
+		}
+	}
+}
+
+func TestSSHConfigPatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		host     string
+		match    bool
+	}{
+		{[]string{"*"}, "anything", true},
+		{[]string{"host?"}, "host1", true},
+		{[]string{"host?"}, "host12", false},
+		{[]string{"*.example.com"}, "a.b.example.com", true},
+		{[]string{"*.example.com"}, "example.com", false},
+		{[]string{"*", "!secret"}, "secret", false},
+		{[]string{"!secret"}, "other", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchSSHConfigPatterns(tt.patterns, tt.host); got != tt.match {
+			t.Errorf("matchSSHConfigPatterns(%q, %q) = %t, expected %t", tt.patterns, tt.host, got, tt.match)
+		}
+	}
+}
+
+func TestResolveHostWithSSHConfigFile(t *testing.T) {
+	f, err := parseSSHConfig(strings.NewReader(testSSHConfigFile))
+	if err != nil {
+		t.Fatalf("Unexpected parse error: %s", err)
+	}
+
+	config := &Config{
+		SSHConfig: &ssh.ClientConfig{User: "configUser"},
+		HostConfigs: map[string]*HostConfig{
+			"db1": {User: "overrideUser"},
+		},
+		sshConfigFile: f,
+	}
+
+	target, err := resolveHost("web-1.example.com", config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if target.addr != "web-1.example.com:2222" || target.sshConfig.User != "defaultUser" {
+		t.Errorf("Unexpected target: %s@%s", target.sshConfig.User, target.addr)
+	}
+	if len(target.jumps) != 2 {
+		t.Fatalf("Expected 2 jump hosts, got %d", len(target.jumps))
+	}
+	if target.jumps[0].addr != "bastion.example.com:2200" || target.jumps[0].sshConfig.User != "jumpUser" {
+		t.Errorf("Unexpected first jump host: %s@%s", target.jumps[0].sshConfig.User, target.jumps[0].addr)
+	}
+	if target.jumps[1].addr != "db1.internal:22" || target.jumps[1].sshConfig.User != "defaultUser" {
+		t.Errorf("Unexpected second jump host: %s@%s", target.jumps[1].sshConfig.User, target.jumps[1].addr)
+	}
+
+	target, err = resolveHost("db1:2200", config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if target.addr != "db1.internal:2200" || target.sshConfig.User != "defaultUser" {
+		t.Errorf("Unexpected target: %s@%s", target.sshConfig.User, target.addr)
+	}
+
+	target, err = resolveHost("db1", config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if target.addr != "db1.internal:22" || target.sshConfig.User != "overrideUser" {
+		t.Errorf("Unexpected target: %s@%s", target.sshConfig.User, target.addr)
+	}
+}
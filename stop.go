@@ -0,0 +1,134 @@
+package massh
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"time"
+)
+
+// defaultStopGrace is how long a command has to exit after being sent Config.StopSignal, if Config.StopGrace isn't
+// set.
+const defaultStopGrace = 5 * time.Second
+
+// StopAction records how a job was stopped, when it was cancelled or timed out before it completed.
+type StopAction int
+
+const (
+	// StopNone means the job wasn't stopped.
+	StopNone StopAction = iota
+	// StopSignalled means Config.StopSignal was sent, and the command exited during the grace period.
+	StopSignalled
+	// StopClosed means the connection was closed, either straight away, or because the command was still running once
+	// the grace period was over.
+	StopClosed
+)
+
+func (a StopAction) String() string {
+	switch a {
+	case StopSignalled:
+		return "signalled"
+	case StopClosed:
+		return "closed"
+	}
+	return "none"
+}
+
+// stopReason is why a jobWatcher stopped a job.
+type stopReason int
+
+const (
+	notStopped stopReason = iota
+	stoppedByCancel
+	stoppedByDeadline
+)
+
+// jobWatcher stops a single job when it's host is cancelled, or it reaches it's deadline. Config.StopSignal is sent to
+// the remote command first, if set, and the connection is closed if it hasn't exited by the end of the grace period.
+type jobWatcher struct {
+	done   chan struct{}
+	exited chan struct{}
+
+	// Only written by the watcher, and safe to read once exited is closed.
+	reason stopReason
+	action StopAction
+}
+
+// watchJob starts watching the job running in session. finish must be called once the job has exited.
+func (conn *hostConnection) watchJob(ex *execution, session *ssh.Session) *jobWatcher {
+	w := &jobWatcher{
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+
+	jobDeadline := conn.jobDeadline(ex.config.JobTimeout)
+	client := conn.client
+	go func() {
+		defer close(w.exited)
+
+		// A nil channel never fires, so jobs without a deadline only wait for cancellation.
+		var deadline <-chan time.Time
+		if !jobDeadline.IsZero() {
+			t := time.NewTimer(time.Until(jobDeadline))
+			defer t.Stop()
+			deadline = t.C
+		}
+
+		select {
+		case <-w.done:
+			return
+		case <-deadline:
+			w.reason = stoppedByDeadline
+		case <-conn.ctx.Done():
+			w.reason = stoppedByCancel
+		}
+
+		if ex.config.StopSignal != "" {
+			grace := ex.config.StopGrace
+			if grace == 0 {
+				grace = defaultStopGrace
+			}
+
+			// If the signal can't be sent, we'll still close the connection once the grace period is over.
+			session.Signal(ex.config.StopSignal)
+
+			g := time.NewTimer(grace)
+			defer g.Stop()
+			select {
+			case <-g.C:
+			case <-w.done:
+				w.action = StopSignalled
+				return
+			}
+		}
+
+		// Close the underlying network connection, not the session as it doesn't close the pipes correctly.
+		client.Close()
+		w.action = StopClosed
+	}()
+
+	return w
+}
+
+// finish stops the watcher once the job has exited, and reports why the job was stopped, if it was. If the
+// connection was closed, it's forgotten so that the next job can reconnect.
+func (w *jobWatcher) finish(conn *hostConnection, r *Result) stopReason {
+	close(w.done)
+	<-w.exited
+
+	if w.action == StopClosed {
+		conn.client = nil
+	}
+	r.StopAction = w.action
+	return w.reason
+}
+
+// requestPTY requests a pseudo-terminal for session, if enabled in config.
+func requestPTY(config *Config, session *ssh.Session) error {
+	if !config.RequestPTY {
+		return nil
+	}
+	if err := session.RequestPty("xterm", 40, 80, ssh.TerminalModes{}); err != nil {
+		return fmt.Errorf("could not request pty: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package massh
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// errDeadline is the cause of an ErrTimeout when a host or job runs for longer than Config.HostTimeout or
+// Config.JobTimeout.
+var errDeadline = fmt.Errorf("job didn't finish before it's deadline: %w", context.DeadlineExceeded)
+
+// jobDeadline returns the time the next job must finish by, which is zero if there's no limit.
+func (conn *hostConnection) jobDeadline(jobTimeout time.Duration) time.Time {
+	deadline := conn.deadline
+	if jobTimeout > 0 {
+		if jobDeadline := time.Now().Add(jobTimeout); deadline.IsZero() || jobDeadline.Before(deadline) {
+			deadline = jobDeadline
+		}
+	}
+	return deadline
+}
+
+// pastDeadline reports whether the host has run for longer than Config.HostTimeout.
+func (conn *hostConnection) pastDeadline() bool {
+	return !conn.deadline.IsZero() && !time.Now().Before(conn.deadline)
+}